@@ -1,15 +1,32 @@
 package apk
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
 	"unicode/utf16"
 )
 
+// ManifestReader encodes the text AndroidManifest.xml read from r into
+// Android's binary XML format. It returns a reader over the encoded
+// manifest and its length in bytes, for callers writing the manifest into
+// their own ZIP archive. A Writer does this for AndroidManifest.xml.
+//
+// The string pool precedes the elements that refer to it, so the whole
+// manifest is encoded before the returned reader is available.
+func ManifestReader(r io.Reader) (io.Reader, int, error) {
+	b, err := binaryXML(r, false)
+	if err != nil {
+		return nil, 0, fmt.Errorf("apk: %v", err)
+	}
+	return bytes.NewReader(b), len(b), nil
+}
+
 // binaryXML converts XML into Android's undocumented binary XML format.
 //
 // The best source of information on this format seems to be the source code
@@ -62,14 +79,54 @@ import (
 //		(ResXMLTree_node; ResXMLTree_endElementExt)
 //	...
 //	Chunk: Namespace End
-func binaryXML(r io.Reader) ([]byte, error) {
+//
+// For a release build, an application with android:debuggable set is
+// an error.
+func binaryXML(r io.Reader, release bool) ([]byte, error) {
 	lr := &lineReader{r: r}
 	d := xml.NewDecoder(lr)
 
 	pool := new(binStringPool)
+	pkg := "" // manifest package, for expanding class names
+	targetSdk, minSdk := 0, 0
 	depth := 0
 	elements := []chunk{}
-	namespaceEnds := make(map[int]binEndNamspace)
+	namespaceEnds := make(map[int][]binEndNamspace)
+	var components []*component // open activity, service and receiver elements
+	var unexported []*component // closed components with an intent-filter but no android:exported
+
+	var text []byte // character data since the last element boundary
+	textLine := 0
+	flushText := func() {
+		// The aapt tool appears to "compact" leading and
+		// trailing whitepsace. See XMLNode::removeWhitespace in
+		// https://android.googlesource.com/platform/frameworks/base.git/+/master/tools/aapt/XMLNode.cpp
+		tok := text
+		text = text[:0]
+		start, end := 0, len(tok)
+		for start < len(tok) && isSpace(tok[start]) {
+			start++
+		}
+		for end > start && isSpace(tok[end-1]) {
+			end--
+		}
+		if start == end {
+			return // all whitespace, skip it
+		}
+
+		// Preserve one character of whitespace.
+		if start > 0 {
+			start--
+		}
+		if end < len(tok) {
+			end++
+		}
+
+		elements = append(elements, &binCharData{
+			line: textLine,
+			data: pool.get(string(tok[start:end])),
+		})
+	}
 
 	for {
 		line := lr.line(d.InputOffset())
@@ -78,29 +135,95 @@ func binaryXML(r io.Reader) ([]byte, error) {
 			if err == io.EOF {
 				break
 			}
+			if err, ok := err.(*xml.SyntaxError); ok {
+				// Prefixed with the line like the encoder's own errors.
+				return nil, fmt.Errorf("%d: %s", err.Line, err.Msg)
+			}
 			return nil, err
 		}
+		switch tok.(type) {
+		case xml.StartElement, xml.EndElement:
+			flushText()
+		}
 		switch tok := tok.(type) {
 		case xml.StartElement:
+			if depth == 0 && tok.Name.Local != "manifest" {
+				return nil, fmt.Errorf("%d: root element is <%s>, want <manifest>", line, tok.Name.Local)
+			}
+			if depth == 0 && len(elements) > 0 {
+				return nil, fmt.Errorf("%d: second root element <%s>", line, tok.Name.Local)
+			}
+
+			// The tools namespace holds instructions for build tools,
+			// such as the manifest merger, and is not part of the app.
+			if v, _ := attrValue(tok, toolsSchema, "node"); v == "remove" {
+				if err := d.Skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			switch tok.Name.Local {
+			case "manifest":
+				pkg, _ = attrValue(tok, "", "package")
+				if err := checkPackageName(pkg); pkg != "" && err != nil {
+					return nil, fmt.Errorf("%d: invalid package name %q: %v", line, pkg, err)
+				}
+			case "uses-sdk":
+				if v, ok := attrValue(tok, androidSchema, "targetSdkVersion"); ok {
+					targetSdk, _ = strconv.Atoi(v)
+				}
+				if v, ok := attrValue(tok, androidSchema, "minSdkVersion"); ok {
+					minSdk, _ = strconv.Atoi(v)
+				}
+			case "activity", "activity-alias", "service", "receiver":
+				_, exported := attrValue(tok, androidSchema, "exported")
+				components = append(components, &component{
+					line:     line,
+					depth:    depth,
+					name:     tok.Name.Local,
+					exported: exported,
+				})
+			case "intent-filter":
+				if n := len(components); n > 0 && components[n-1].depth == depth-1 {
+					components[n-1].intentFilter = true
+				}
+			}
+
 			// Intercept namespace definitions.
 			var attr []*binAttr
+			seen := make(map[xml.Name]bool)
 			for _, a := range tok.Attr {
+				if seen[a.Name] {
+					return nil, fmt.Errorf("%d: %s: duplicate attribute %s", line, tok.Name.Local, a.Name.Local)
+				}
+				seen[a.Name] = true
+				if a.Name.Space == toolsSchema || a.Name.Space == "xmlns" && a.Value == toolsSchema {
+					continue
+				}
 				if a.Name.Space == "xmlns" {
 					elements = append(elements, binStartNamspace{
 						line:   line,
 						prefix: pool.get(a.Name.Local),
 						url:    pool.get(a.Value),
 					})
-					namespaceEnds[depth] = binEndNamspace{
-						line:   line,
+					// Stored under the depth before this element is
+					// entered, which is the depth after it is left.
+					namespaceEnds[depth] = append(namespaceEnds[depth], binEndNamspace{
 						prefix: pool.get(a.Name.Local),
 						url:    pool.get(a.Value),
-					}
+					})
 					continue
 				}
+				if isClassAttr(tok.Name.Local, a.Name) {
+					a.Value = fullClassName(pkg, a.Value)
+				}
 				ba, err := pool.getAttr(a)
 				if err != nil {
-					return nil, fmt.Errorf("%d: %s: %v", line, a.Name.Local, err)
+					return nil, fmt.Errorf("%d: %s: %v", line, tok.Name.Local, err)
+				}
+				if release && tok.Name.Local == "application" && a.Name.Space == androidSchema && a.Name.Local == "debuggable" && ba.data == true {
+					return nil, fmt.Errorf("%d: application: android:debuggable is true in a release build", line)
 				}
 				attr = append(attr, ba)
 			}
@@ -119,40 +242,28 @@ func binaryXML(r io.Reader) ([]byte, error) {
 				name: pool.get(tok.Name.Local),
 			})
 			depth--
-			if nsEnd, ok := namespaceEnds[depth]; ok {
-				delete(namespaceEnds, depth)
+			if n := len(components); n > 0 && components[n-1].depth == depth {
+				c := components[n-1]
+				components = components[:n-1]
+				if c.intentFilter && !c.exported {
+					unexported = append(unexported, c)
+				}
+			}
+			// Namespaces end in the reverse order they started.
+			nsEnds := namespaceEnds[depth]
+			delete(namespaceEnds, depth)
+			for i := len(nsEnds) - 1; i >= 0; i-- {
+				nsEnd := nsEnds[i]
+				nsEnd.line = line
 				elements = append(elements, nsEnd)
 			}
 		case xml.CharData:
-			// The aapt tool appears to "compact" leading and
-			// trailing whitepsace. See XMLNode::removeWhitespace in
-			// https://android.googlesource.com/platform/frameworks/base.git/+/master/tools/aapt/XMLNode.cpp
-			if len(tok) == 0 {
-				continue
+			// The decoder splits one run of text around CDATA
+			// sections and comments. Collect it into one node.
+			if len(text) == 0 {
+				textLine = line
 			}
-			start, end := 0, len(tok)
-			for start < len(tok) && isSpace(tok[start]) {
-				start++
-			}
-			for end > start && isSpace(tok[end-1]) {
-				end--
-			}
-			if start == end {
-				continue // all whitespace, skip it
-			}
-
-			// Preserve one character of whitespace.
-			if start > 0 {
-				start--
-			}
-			if end < len(tok) {
-				end++
-			}
-
-			elements = append(elements, &binCharData{
-				line: line,
-				data: pool.get(string(tok[start:end])),
-			})
+			text = append(text, tok...)
 		case xml.Comment:
 			// Ignored by Anroid Binary XML format.
 		case xml.ProcInst:
@@ -164,6 +275,20 @@ func binaryXML(r io.Reader) ([]byte, error) {
 		}
 	}
 
+	if len(elements) == 0 {
+		return nil, fmt.Errorf("no manifest root element found")
+	}
+
+	// Android 12 refuses to install such an app. The target SDK defaults
+	// to the minimum, and <uses-sdk> may come after the components.
+	if targetSdk == 0 {
+		targetSdk = minSdk
+	}
+	if targetSdk >= 31 && len(unexported) > 0 {
+		c := unexported[0]
+		return nil, fmt.Errorf("%d: %s: android:exported must be set on components with an intent-filter when targetSdkVersion >= 31", c.line, c.name)
+	}
+
 	sortPool(pool)
 	for _, e := range elements {
 		if e, ok := e.(*binStartElement); ok {
@@ -189,6 +314,108 @@ func binaryXML(r io.Reader) ([]byte, error) {
 	return b, nil
 }
 
+// component is an open activity, activity-alias, service or receiver.
+type component struct {
+	line         int
+	depth        int
+	name         string
+	exported     bool // android:exported is set
+	intentFilter bool // has a child intent-filter
+}
+
+// attrValue returns the value of the attribute space:local of e.
+func attrValue(e xml.StartElement, space, local string) (string, bool) {
+	for _, a := range e.Attr {
+		if a.Name.Space == space && a.Name.Local == local {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// checkPackageName reports why pkg is not a package name Android will
+// install. As in the PackageManager, it must have at least two segments
+// separated by dots, each an ASCII letter followed by letters, digits or
+// underscores. The segments must also not be Java reserved words, since
+// the package names the generated R and BuildConfig classes.
+func checkPackageName(pkg string) error {
+	segs := strings.Split(pkg, ".")
+	if len(segs) < 2 {
+		return fmt.Errorf("must have at least one '.' separator")
+	}
+	for _, seg := range segs {
+		if seg == "" {
+			return fmt.Errorf("empty segment")
+		}
+		for i, c := range seg {
+			switch {
+			case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+			case i > 0 && ('0' <= c && c <= '9' || c == '_'):
+			case i == 0:
+				return fmt.Errorf("segment %q does not start with a letter", seg)
+			default:
+				return fmt.Errorf("segment %q contains bad character %q", seg, c)
+			}
+		}
+		if javaReserved[seg] {
+			return fmt.Errorf("segment %q is a Java reserved word", seg)
+		}
+	}
+	return nil
+}
+
+// javaReserved holds the Java keywords and literals, which cannot be
+// used as identifiers.
+var javaReserved = map[string]bool{
+	"abstract": true, "assert": true, "boolean": true, "break": true,
+	"byte": true, "case": true, "catch": true, "char": true,
+	"class": true, "const": true, "continue": true, "default": true,
+	"do": true, "double": true, "else": true, "enum": true,
+	"extends": true, "false": true, "final": true, "finally": true,
+	"float": true, "for": true, "goto": true, "if": true,
+	"implements": true, "import": true, "instanceof": true, "int": true,
+	"interface": true, "long": true, "native": true, "new": true,
+	"null": true, "package": true, "private": true, "protected": true,
+	"public": true, "return": true, "short": true, "static": true,
+	"strictfp": true, "super": true, "switch": true, "synchronized": true,
+	"this": true, "throw": true, "throws": true, "transient": true,
+	"true": true, "try": true, "void": true, "volatile": true,
+	"while": true,
+}
+
+// isClassAttr reports whether the attribute attr of element elem names a
+// Java class. The aapt tool expands these relative to the package.
+func isClassAttr(elem string, attr xml.Name) bool {
+	if attr.Space != androidSchema {
+		return false
+	}
+	switch elem {
+	case "application":
+		switch attr.Local {
+		case "name", "appComponentFactory", "backupAgent":
+			return true
+		}
+	case "activity", "activity-alias", "service", "receiver", "provider":
+		return attr.Local == "name"
+	}
+	return false
+}
+
+// fullClassName expands a class name relative to pkg, as aapt does.
+// Both ".Foo" and "Foo" become "pkg.Foo".
+func fullClassName(pkg, name string) string {
+	if pkg == "" || name == "" {
+		return name
+	}
+	if name[0] == '.' {
+		return pkg + name
+	}
+	if !strings.Contains(name, ".") {
+		return pkg + "." + name
+	}
+	return name
+}
+
 func isSpace(b byte) bool {
 	switch b {
 	case '\t', '\n', '\v', '\f', '\r', ' ', 0x85, 0xA0:
@@ -208,6 +435,8 @@ const (
 	headerStartElement              = 0x0102
 	headerEndElement                = 0x0103
 	headerCharData                  = 0x0104
+	headerTable                     = 0x0002
+	headerTablePackage              = 0x0200
 )
 
 func appendU16(b []byte, v uint16) []byte {
@@ -221,11 +450,15 @@ func appendU32(b []byte, v uint32) []byte {
 func appendHeader(b []byte, typ headerType, size int) []byte {
 	b = appendU16(b, uint16(typ))
 	b = appendU16(b, 8)
-	b = appendU16(b, uint16(size))
-	b = appendU16(b, 0)
+	b = appendU32(b, uint32(size))
 	return b
 }
 
+const (
+	androidSchema = "http://schemas.android.com/apk/res/android"
+	toolsSchema   = "http://schemas.android.com/tools"
+)
+
 // Attributes of the form android:key are mapped to resource IDs, which are
 // embedded into the Binary XML format.
 //
@@ -241,24 +474,178 @@ var resourceCodes = map[string]uint32{
 	"name":             0x01010003,
 	"configChanges":    0x0101001f,
 	"value":            0x01010024,
+	"resource":         0x01010025,
+	"permission":       0x01010006,
+	"process":          0x01010011,
+	"taskAffinity":     0x01010012,
+	"authorities":      0x01010018,
+	"required":         0x0101028e,
+	"exported":         0x01010010,
+	"targetSdkVersion": 0x01010270,
+	"icon":             0x01010002,
+	"roundIcon":        0x0101052c,
+	"banner":           0x010103f2,
+	"theme":            0x01010000,
+	"localeConfig":     0x0101065b,
+
+	"anyDensity":              0x0101026c,
+	"smallScreens":            0x01010284,
+	"normalScreens":           0x01010285,
+	"largeScreens":            0x01010286,
+	"xlargeScreens":           0x010102bf,
+	"resizeable":              0x0101028d,
+	"requiresSmallestWidthDp": 0x01010364,
+	"compatibleWidthLimitDp":  0x01010365,
+	"largestWidthLimitDp":     0x01010366,
+	"screenSize":              0x010102ca,
+	"screenDensity":           0x010102cb,
+	"usesPermissionFlags":     0x01010644,
+	"isFeatureSplit":          0x0101055b,
+	"appComponentFactory":     0x0101057a,
+	"glEsVersion":             0x01010281,
+	"version":                 0x01010519,
+	"shell":                   0x01010594,
+	"enabled":                 0x0101000e,
+	"networkSecurityConfig":   0x01010527,
+	"dataExtractionRules":     0x0101063e,
+	"fullBackupContent":       0x010104eb,
+	"backupAgent":             0x0101027f,
+	"allowBackup":             0x01010280,
+	"readPermission":          0x01010007,
+	"writePermission":         0x01010008,
+	"grantUriPermissions":     0x0101001b,
+	"path":                    0x0101002a,
+	"pathPrefix":              0x0101002b,
+	"pathPattern":             0x0101002c,
+	"sharedUserId":            0x0101000b,
+	"sharedUserMaxSdkVersion": 0x0101064d,
+	"directBootAware":         0x01010505,
+	"minWidth":                0x0101013f,
+	"minHeight":               0x01010140,
+	"maxAspectRatio":          0x01010560,
+	"maxRecents":              0x01010446,
+	"foregroundServiceType":   0x0101059f,
+}
+
+// Attributes holding a set of flags, encoded as INT_HEX.
+var flags = map[string]map[string]uint32{
+	"configChanges":         configChanges,
+	"usesPermissionFlags":   usesPermissionFlags,
+	"foregroundServiceType": foregroundServiceType,
 }
 
 // http://developer.android.com/reference/android/R.attr.html#configChanges
 var configChanges = map[string]uint32{
-	"mcc":                0x0001,
-	"mnc":                0x0002,
-	"locale":             0x0004,
-	"touchscreen":        0x0008,
-	"keyboard":           0x0010,
-	"keyboardHidden":     0x0020,
-	"navigation":         0x0040,
-	"orientation":        0x0080,
-	"screenLayout":       0x0100,
-	"uiMode":             0x0200,
-	"screenSize":         0x0400,
-	"smallestScreenSize": 0x0800,
-	"layoutDirection":    0x2000,
-	"fontScale":          0x40000000,
+	"mcc":                  0x0001,
+	"mnc":                  0x0002,
+	"locale":               0x0004,
+	"touchscreen":          0x0008,
+	"keyboard":             0x0010,
+	"keyboardHidden":       0x0020,
+	"navigation":           0x0040,
+	"orientation":          0x0080,
+	"screenLayout":         0x0100,
+	"uiMode":               0x0200,
+	"screenSize":           0x0400,
+	"smallestScreenSize":   0x0800,
+	"density":              0x1000,
+	"layoutDirection":      0x2000,
+	"colorMode":            0x4000,
+	"grammaticalGender":    0x8000,
+	"fontWeightAdjustment": 0x10000000,
+	"fontScale":            0x40000000,
+}
+
+// Framework resources that manifests commonly refer to, of the form
+// @android:type/name. They are encoded as references, and any other
+// @android: reference is an error.
+//
+// http://developer.android.com/reference/android/R.style.html
+var frameworkResources = map[string]uint32{
+	"style/Theme":                                   0x01030005,
+	"style/Theme.NoTitleBar":                        0x01030006,
+	"style/Theme.NoTitleBar.Fullscreen":             0x01030007,
+	"style/Theme.Black":                             0x01030008,
+	"style/Theme.Black.NoTitleBar":                  0x01030009,
+	"style/Theme.Black.NoTitleBar.Fullscreen":       0x0103000a,
+	"style/Theme.Dialog":                            0x0103000b,
+	"style/Theme.Light":                             0x0103000c,
+	"style/Theme.Light.NoTitleBar":                  0x0103000d,
+	"style/Theme.Light.NoTitleBar.Fullscreen":       0x0103000e,
+	"style/Theme.Translucent":                       0x0103000f,
+	"style/Theme.Translucent.NoTitleBar":            0x01030010,
+	"style/Theme.Translucent.NoTitleBar.Fullscreen": 0x01030011,
+
+	"style/Theme.Holo":                                       0x0103006b,
+	"style/Theme.Holo.NoActionBar":                           0x0103006c,
+	"style/Theme.Holo.NoActionBar.Fullscreen":                0x0103006d,
+	"style/Theme.Holo.Light":                                 0x0103006e,
+	"style/Theme.Holo.Dialog":                                0x0103006f,
+	"style/Theme.Holo.Light.NoActionBar":                     0x010300f0,
+	"style/Theme.Holo.Light.NoActionBar.Fullscreen":          0x010300f1,
+	"style/Theme.Holo.Light.DarkActionBar":                   0x01030119,
+	"style/Theme.DeviceDefault":                              0x01030128,
+	"style/Theme.DeviceDefault.NoActionBar":                  0x01030129,
+	"style/Theme.DeviceDefault.NoActionBar.Fullscreen":       0x0103012a,
+	"style/Theme.DeviceDefault.Light":                        0x0103012b,
+	"style/Theme.DeviceDefault.Light.NoActionBar":            0x01030132,
+	"style/Theme.DeviceDefault.Light.NoActionBar.Fullscreen": 0x01030133,
+	"style/Theme.DeviceDefault.Light.DarkActionBar":          0x0103013f,
+	"style/Theme.Material":                                   0x01030224,
+	"style/Theme.Material.Dialog":                            0x01030225,
+	"style/Theme.Material.NoActionBar":                       0x0103022d,
+	"style/Theme.Material.NoActionBar.Fullscreen":            0x0103022e,
+	"style/Theme.Material.Light":                             0x01030237,
+	"style/Theme.Material.Light.DarkActionBar":               0x01030238,
+	"style/Theme.Material.Light.Dialog":                      0x01030239,
+	"style/Theme.Material.Light.NoActionBar":                 0x01030240,
+	"style/Theme.Material.Light.NoActionBar.Fullscreen":      0x01030241,
+
+	"drawable/sym_def_app_icon": 0x01080093,
+}
+
+// Attributes with enumerated values, encoded as INT_DEC.
+//
+// http://developer.android.com/guide/topics/manifest/compatible-screens-element.html
+var enums = map[string]map[string]int{
+	"screenSize": {
+		"small":  200,
+		"normal": 300,
+		"large":  400,
+		"xlarge": 500,
+	},
+	"screenDensity": {
+		"ldpi":    120,
+		"mdpi":    160,
+		"hdpi":    240,
+		"xhdpi":   320,
+		"xxhdpi":  480,
+		"xxxhdpi": 640,
+	},
+}
+
+// http://developer.android.com/reference/android/R.attr.html#usesPermissionFlags
+var usesPermissionFlags = map[string]uint32{
+	"neverForLocation": 0x00010000,
+}
+
+// http://developer.android.com/reference/android/R.attr.html#foregroundServiceType
+var foregroundServiceType = map[string]uint32{
+	"dataSync":        0x0001,
+	"mediaPlayback":   0x0002,
+	"phoneCall":       0x0004,
+	"location":        0x0008,
+	"connectedDevice": 0x0010,
+	"mediaProjection": 0x0020,
+	"camera":          0x0040,
+	"microphone":      0x0080,
+	"health":          0x0100,
+	"remoteMessaging": 0x0200,
+	"systemExempted":  0x0400,
+	"shortService":    0x0800,
+	"fileManagement":  0x1000,
+	"mediaProcessing": 0x2000,
+	"specialUse":      0x40000000,
 }
 
 type lineReader struct {
@@ -286,6 +673,7 @@ func (r *lineReader) line(pos int64) int {
 
 type bstring struct {
 	ind uint32
+	id  uint32 // resource ID, set only on android attribute names
 	str string
 	enc []byte // 2-byte length, utf16le, 2-byte zero
 }
@@ -300,13 +688,15 @@ type binResMap struct {
 }
 
 func (p *binResMap) append(b []byte) []byte {
+	if p.size() == 0 {
+		return b
+	}
 	b = appendHeader(b, headerResourceMap, p.size())
 	for _, bstr := range p.pool.s {
-		c, ok := resourceCodes[bstr.str]
-		if !ok {
+		if bstr.id == 0 {
 			break
 		}
-		b = appendU32(b, c)
+		b = appendU32(b, bstr.id)
 	}
 	return b
 }
@@ -314,41 +704,74 @@ func (p *binResMap) append(b []byte) []byte {
 func (p *binResMap) size() int {
 	count := 0
 	for _, bstr := range p.pool.s {
-		if _, ok := resourceCodes[bstr.str]; !ok {
+		if bstr.id == 0 {
 			break
 		}
 		count++
 	}
+	if count == 0 {
+		return 0 // like aapt, omit an empty resource map
+	}
 	return 8 + 4*count
 }
 
+// poolKey identifies a pool entry. An android attribute name with a
+// resource ID is a separate entry from the same string used elsewhere,
+// so the resource map only covers names in the android namespace.
+type poolKey struct {
+	str string
+	id  uint32
+}
+
 type binStringPool struct {
 	s []*bstring
-	m map[string]*bstring
+	m map[poolKey]*bstring
 }
 
 func (p *binStringPool) get(str string) *bstring {
+	return p.getID(str, 0)
+}
+
+func (p *binStringPool) getID(str string, id uint32) *bstring {
 	if p.m == nil {
-		p.m = make(map[string]*bstring)
+		p.m = make(map[poolKey]*bstring)
 	}
-	res := p.m[str]
+	key := poolKey{str, id}
+	res := p.m[key]
 	if res != nil {
 		return res
 	}
 	res = &bstring{
 		ind: uint32(len(p.s)),
+		id:  id,
 		str: str,
 	}
 	p.s = append(p.s, res)
-	p.m[str] = res
+	p.m[key] = res
 
-	if len(str)>>16 > 0 {
-		panic(fmt.Sprintf("string lengths over 1<<15 not yet supported, got len %d for string that starts %q", len(str), str[:100]))
+	// The length is counted in UTF-16 code units, so a supplementary
+	// plane character counts twice. The top bit marks a two-word length.
+	n := 0
+	for _, r := range str {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
 	}
-	strUTF16 := utf16.Encode([]rune(str))
-	res.enc = appendU16(nil, uint16(len(strUTF16)))
-	for _, w := range strUTF16 {
-		res.enc = appendU16(res.enc, w)
+	if n > 0x7fff {
+		panic(fmt.Sprintf("string lengths over 1<<15 not yet supported, got len %d for string that starts %q", n, str[:100]))
+	}
+	res.enc = make([]byte, 0, 2*(n+2))
+	res.enc = appendU16(res.enc, uint16(n))
+	for _, r := range str {
+		if r >= 0x10000 {
+			r1, r2 := utf16.EncodeRune(r)
+			res.enc = appendU16(res.enc, uint16(r1))
+			res.enc = appendU16(res.enc, uint16(r2))
+		} else {
+			res.enc = appendU16(res.enc, uint16(r))
+		}
 	}
 	res.enc = appendU16(res.enc, 0)
 	return res
@@ -364,40 +787,197 @@ func (p *binStringPool) getNS(ns string) *bstring {
 
 func (p *binStringPool) getAttr(attr xml.Attr) (*binAttr, error) {
 	a := &binAttr{
-		ns:   p.getNS(attr.Name.Space),
-		name: p.get(attr.Name.Local),
+		ns: p.getNS(attr.Name.Space),
 	}
-	if attr.Name.Space != "http://schemas.android.com/apk/res/android" {
+	if attr.Name.Space != androidSchema {
+		a.name = p.get(attr.Name.Local)
 		a.data = p.get(attr.Value)
 		return a, nil
 	}
+	a.name = p.getID(attr.Name.Local, resourceCodes[attr.Name.Local])
+
+	switch attr.Value {
+	case "@null":
+		a.data = nullValue(0) // DATA_NULL_UNDEFINED
+		return a, nil
+	case "@empty":
+		a.data = nullValue(1) // DATA_NULL_EMPTY
+		return a, nil
+	}
+	if strings.HasPrefix(attr.Value, "@android:") {
+		if id, ok := frameworkResources[attr.Value[len("@android:"):]]; ok {
+			a.data = reference(id)
+			return a, nil
+		}
+	}
+	if strings.HasPrefix(attr.Value, "@android:") {
+		return nil, fmt.Errorf("%s: unknown framework resource %q", attr.Name.Local, attr.Value)
+	}
+	if strings.HasPrefix(attr.Value, "@") {
+		// Without a resource table there is no ID to refer to, and
+		// Android ignores a string where it expects a reference.
+		return nil, fmt.Errorf("%s: cannot resolve %q: app resources are not compiled by this package", attr.Name.Local, attr.Value)
+	}
 
 	// Some android attributes have interesting values.
 	switch attr.Name.Local {
-	case "versionCode", "minSdkVersion":
+	case "versionCode", "minSdkVersion", "targetSdkVersion",
+		"requiresSmallestWidthDp", "compatibleWidthLimitDp", "largestWidthLimitDp",
+		"version", "sharedUserMaxSdkVersion", "maxRecents":
 		v, err := strconv.Atoi(attr.Value)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %v", attr.Name.Local, err)
 		}
 		a.data = int(v)
-	case "hasCode", "debuggable":
+	case "hasCode", "debuggable", "required", "exported",
+		"anyDensity", "smallScreens", "normalScreens", "largeScreens", "xlargeScreens", "resizeable",
+		"isFeatureSplit", "shell", "enabled", "allowBackup", "grantUriPermissions",
+		"directBootAware":
 		v, err := strconv.ParseBool(attr.Value)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %v", attr.Name.Local, err)
 		}
 		a.data = v
-	case "configChanges":
+	case "minWidth", "minHeight":
+		v, err := parseDimension(attr.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", attr.Name.Local, err)
+		}
+		a.data = v
+	case "maxAspectRatio":
+		v, err := strconv.ParseFloat(attr.Value, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", attr.Name.Local, err)
+		}
+		a.data = float32(v)
+	case "glEsVersion":
+		// The major version in the high 16 bits, usually written in
+		// hex. Like aapt, the type follows how the number is written.
+		v, err := parseUint32(attr.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", attr.Name.Local, err)
+		}
+		if strings.HasPrefix(attr.Value, "0x") || strings.HasPrefix(attr.Value, "0X") {
+			a.data = v
+		} else {
+			a.data = int(v)
+		}
+	case "configChanges", "usesPermissionFlags", "foregroundServiceType":
+		// A number is kept as is, so a flag added in a newer
+		// Android version can still be set.
 		v := uint32(0)
 		for _, c := range strings.Split(attr.Value, "|") {
-			v |= configChanges[c]
+			c = strings.TrimSpace(c)
+			f, ok := flags[attr.Name.Local][c]
+			if !ok {
+				var err error
+				if f, err = parseUint32(c); err != nil {
+					return nil, fmt.Errorf("%s: unknown flag %q", attr.Name.Local, c)
+				}
+			}
+			v |= f
 		}
 		a.data = v
+	case "screenSize", "screenDensity":
+		v, ok := enums[attr.Name.Local][attr.Value]
+		if !ok {
+			var err error
+			if v, err = strconv.Atoi(attr.Value); err != nil {
+				return nil, fmt.Errorf("%s: unknown value %q", attr.Name.Local, attr.Value)
+			}
+		}
+		a.data = v
+	case "fullBackupContent":
+		// Either a reference to the backup rules, or false to opt
+		// out of full backup.
+		if v, err := strconv.ParseBool(attr.Value); err == nil {
+			a.data = v
+		} else {
+			a.data = p.get(attr.Value)
+		}
+	case "value":
+		a.data = p.getValue(attr.Value)
 	default:
 		a.data = p.get(attr.Value)
 	}
 	return a, nil
 }
 
+// parseUint32 parses a 32-bit number written in hex with a 0x prefix,
+// or otherwise in decimal. Unlike strconv with base 0, a leading zero
+// does not make it octal.
+func parseUint32(s string) (uint32, error) {
+	base := 10
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s, base = s[2:], 16
+	}
+	v, err := strconv.ParseUint(s, base, 32)
+	return uint32(v), err
+}
+
+// getValue returns the data for a meta-data android:value. Like aapt,
+// it is the first of an integer, a float, a boolean, a color or a
+// string that v parses as.
+func (p *binStringPool) getValue(v string) interface{} {
+	if i, err := strconv.ParseInt(v, 10, 32); err == nil {
+		return int(i)
+	}
+	if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+		if u, err := strconv.ParseUint(v[2:], 16, 32); err == nil {
+			return uint32(u)
+		}
+	}
+	if strings.Trim(v, "0123456789.eE+-") == "" { // not NaN or Inf
+		if f, err := strconv.ParseFloat(v, 32); err == nil {
+			return float32(f)
+		}
+	}
+	if b, err := strconv.ParseBool(v); err == nil && (v == "true" || v == "false") {
+		return b
+	}
+	if c, ok := parseColor(v); ok {
+		return c
+	}
+	return p.get(v)
+}
+
+// parseColor parses a #RGB, #ARGB, #RRGGBB or #AARRGGBB color literal.
+// As in aapt, the Res_value type records which form was written, and
+// the data is always the full ARGB value: the short forms have each
+// digit repeated, and the forms without alpha are opaque.
+func parseColor(v string) (color, bool) {
+	if len(v) < 2 || v[0] != '#' {
+		return color{}, false
+	}
+	u, err := strconv.ParseUint(v[1:], 16, 32)
+	if err != nil {
+		return color{}, false
+	}
+	argb := uint32(u)
+	switch len(v) - 1 {
+	case 3:
+		return color{0x1f, 0xff000000 | expandNibbles(argb)}, true // INT_COLOR_RGB4
+	case 4:
+		return color{0x1e, expandNibbles(argb)}, true // INT_COLOR_ARGB4
+	case 6:
+		return color{0x1d, 0xff000000 | argb}, true // INT_COLOR_RGB8
+	case 8:
+		return color{0x1c, argb}, true // INT_COLOR_ARGB8
+	}
+	return color{}, false
+}
+
+// expandNibbles repeats each of the low four hex digits of v, so 0xf08
+// becomes 0xff0088.
+func expandNibbles(v uint32) uint32 {
+	var x uint32
+	for i := uint(0); i < 4; i++ {
+		n := v >> (4 * i) & 0xf
+		x |= (n<<4 | n) << (8 * i)
+	}
+	return x
+}
+
 const stringPoolPreamble = 0 +
 	8 + // chunk header
 	4 + // string count
@@ -425,32 +1005,27 @@ func (p *binStringPool) size() int {
 var (
 	sortPool = func(p *binStringPool) {
 		sort.Sort(p)
-
-		// Move resourceCodes to the front.
-		s := make([]*bstring, 0)
-		m := make(map[string]*bstring)
-		for str := range resourceCodes {
-			bstr := p.m[str]
-			if bstr == nil {
-				continue
-			}
-			bstr.ind = uint32(len(s))
-			s = append(s, bstr)
-			m[str] = bstr
-			delete(p.m, str)
-		}
-		for _, bstr := range p.m {
-			bstr.ind = uint32(len(s))
-			s = append(s, bstr)
-		}
-		p.s = s
-		p.m = m
 	}
-	sortAttr = func(e *binStartElement, p *binStringPool) {}
+	sortAttr = func(e *binStartElement, p *binStringPool) {
+		sort.Sort(byResourceID(e.attr))
+	}
 )
 
-func (b *binStringPool) Len() int           { return len(b.s) }
-func (b *binStringPool) Less(i, j int) bool { return b.s[i].str < b.s[j].str }
+func (b *binStringPool) Len() int { return len(b.s) }
+
+// Less orders strings with a resource ID first, by ID, as the resource
+// map must cover a prefix of the pool. The rest are ordered lexically.
+func (b *binStringPool) Less(i, j int) bool {
+	si, sj := b.s[i], b.s[j]
+	if (si.id == 0) != (sj.id == 0) {
+		return si.id != 0
+	}
+	if si.id != sj.id {
+		return si.id < sj.id
+	}
+	return si.str < sj.str
+}
+
 func (b *binStringPool) Swap(i, j int) {
 	b.s[i], b.s[j] = b.s[j], b.s[i]
 	b.s[i].ind, b.s[j].ind = b.s[j].ind, b.s[i].ind
@@ -460,8 +1035,7 @@ func (p *binStringPool) append(b []byte) []byte {
 	stringsStart := uint32(stringPoolPreamble + 4*len(p.s))
 	b = appendU16(b, uint16(headerStringPool))
 	b = appendU16(b, 0x1c) // chunk header size
-	b = appendU16(b, uint16(p.size()))
-	b = appendU16(b, 0)
+	b = appendU32(b, uint32(p.size()))
 	b = appendU32(b, uint32(len(p.s)))
 	b = appendU32(b, 0) // style count
 	b = appendU32(b, 0) // flags
@@ -504,8 +1078,7 @@ func (e *binStartElement) size() int {
 func (e *binStartElement) append(b []byte) []byte {
 	b = appendU16(b, uint16(headerStartElement))
 	b = appendU16(b, 0x10) // chunk header size
-	b = appendU16(b, uint16(e.size()))
-	b = appendU16(b, 0)
+	b = appendU32(b, uint32(e.size()))
 	b = appendU32(b, uint32(e.line))
 	b = appendU32(b, 0xffffffff) // comment
 	if e.ns == nil {
@@ -526,12 +1099,114 @@ func (e *binStartElement) append(b []byte) []byte {
 	return b
 }
 
+// resValueSize is the size of a Res_value. Each value records its own
+// size, but every type Android defines is this size.
+const resValueSize = 8
+
 type binAttr struct {
 	ns   *bstring
 	name *bstring
-	data interface{} // either int (INT_DEC) or *bstring (STRING)
+	data interface{} // int (INT_DEC), bool, uint32 (INT_HEX), float32, nullValue, reference, dimension, color or *bstring (STRING)
+}
+
+// byResourceID orders attributes by resource ID, which Android uses to
+// binary search them. Attributes without an ID follow, by namespace and
+// then name.
+type byResourceID []*binAttr
+
+func (a byResourceID) Len() int      { return len(a) }
+func (a byResourceID) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byResourceID) Less(i, j int) bool {
+	ai, aj := a[i].name.id, a[j].name.id
+	if (ai == 0) != (aj == 0) {
+		return ai != 0
+	}
+	if ai != aj {
+		return ai < aj
+	}
+	if ni, nj := nsString(a[i].ns), nsString(a[j].ns); ni != nj {
+		return ni < nj
+	}
+	return a[i].name.str < a[j].name.str
+}
+
+func nsString(ns *bstring) string {
+	if ns == nil {
+		return ""
+	}
+	return ns.str
+}
+
+// reference is the resource ID of a REFERENCE attribute value.
+type reference uint32
+
+// color is an INT_COLOR attribute value. typ is one of the four color
+// types, which keep the form of the literal, and argb is its value.
+type color struct {
+	typ  byte
+	argb uint32
 }
 
+// dimension is the data of a DIMENSION attribute value, a number and
+// unit packed into the complex format of Res_value.
+type dimension uint32
+
+var dimensionUnits = map[string]uint32{
+	"px":  0, // COMPLEX_UNIT_PX
+	"dp":  1, // COMPLEX_UNIT_DIP
+	"dip": 1,
+	"sp":  2,
+	"pt":  3,
+	"in":  4,
+	"mm":  5,
+}
+
+// parseDimension parses a dimension such as "300dp", encoding it as
+// ResTable::stringToFloat does in AOSP. The number is stored as a
+// 24-bit mantissa with the radix, the position of its binary point,
+// chosen to keep as much of the fraction as the magnitude allows.
+func parseDimension(v string) (dimension, error) {
+	i := len(v)
+	for i > 0 && (v[i-1] >= 'a' && v[i-1] <= 'z') {
+		i--
+	}
+	unit, ok := dimensionUnits[v[i:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown dimension unit in %q", v)
+	}
+	f, err := strconv.ParseFloat(v[:i], 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dimension %q", v)
+	}
+	neg := f < 0
+	if neg {
+		f = -f
+	}
+	bits := uint64(f*(1<<23) + .5)
+	var radix, shift uint32
+	switch {
+	case bits&0x7fffff == 0:
+		radix, shift = 0, 23 // COMPLEX_RADIX_23p0, no fraction
+	case bits&0xffffffffff800000 == 0:
+		radix, shift = 3, 0 // COMPLEX_RADIX_0p23
+	case bits&0xffffffff80000000 == 0:
+		radix, shift = 2, 8 // COMPLEX_RADIX_8p15
+	case bits&0xffffff8000000000 == 0:
+		radix, shift = 1, 16 // COMPLEX_RADIX_16p7
+	default:
+		radix, shift = 0, 23 // COMPLEX_RADIX_23p0
+	}
+	mantissa := uint32(bits>>shift) & 0xffffff
+	if neg {
+		mantissa = -mantissa & 0xffffff
+	}
+	return dimension(mantissa<<8 | radix<<4 | unit), nil
+}
+
+// nullValue is the data of a NULL attribute value, either
+// DATA_NULL_UNDEFINED (@null) or DATA_NULL_EMPTY (@empty).
+type nullValue uint32
+
 /*
 func (*binAttr) size() int {
 	return 4 + // ns
@@ -551,38 +1226,39 @@ func (a *binAttr) append(b []byte) []byte {
 		b = appendU32(b, 0xffffffff)
 	}
 	b = appendU32(b, a.name.ind)
+
+	// Res_value. Only strings keep a raw value.
+	raw, typ, data := uint32(0xffffffff), byte(0), uint32(0)
 	switch v := a.data.(type) {
 	case int:
-		b = appendU32(b, 0xffffffff) // raw value
-		b = appendU16(b, 8)          // size
-		b = append(b, 0)             // unused padding
-		b = append(b, 0x10)          // INT_DEC
-		b = appendU32(b, uint32(v))
+		typ, data = 0x10, uint32(v) // INT_DEC
 	case bool:
-		b = appendU32(b, 0xffffffff) // raw value
-		b = appendU16(b, 8)          // size
-		b = append(b, 0)             // unused padding
-		b = append(b, 0x12)          // INT_BOOLEAN
+		typ = 0x12 // INT_BOOLEAN
 		if v {
-			b = appendU32(b, 0xffffffff)
-		} else {
-			b = appendU32(b, 0)
+			data = 0xffffffff
 		}
 	case uint32:
-		b = appendU32(b, 0xffffffff) // raw value
-		b = appendU16(b, 8)          // size
-		b = append(b, 0)             // unused padding
-		b = append(b, 0x11)          // INT_HEX
-		b = appendU32(b, uint32(v))
+		typ, data = 0x11, v // INT_HEX
+	case float32:
+		typ, data = 0x04, math.Float32bits(v) // FLOAT
+	case nullValue:
+		typ, data = 0x00, uint32(v) // NULL
+	case reference:
+		typ, data = 0x01, uint32(v) // REFERENCE
+	case dimension:
+		typ, data = 0x05, uint32(v) // DIMENSION
+	case color:
+		typ, data = v.typ, v.argb // INT_COLOR_*
 	case *bstring:
-		b = appendU32(b, v.ind) // raw value
-		b = appendU16(b, 8)     // size
-		b = append(b, 0)        // unused padding
-		b = append(b, 0x03)     // STRING
-		b = appendU32(b, v.ind)
+		raw, typ, data = v.ind, 0x03, v.ind // STRING
 	default:
 		panic(fmt.Sprintf("unexpected attr type: %T (%v)", v, v))
 	}
+	b = appendU32(b, raw)
+	b = appendU16(b, resValueSize)
+	b = append(b, 0) // unused padding
+	b = append(b, typ)
+	b = appendU32(b, data)
 	return b
 }
 
@@ -604,8 +1280,7 @@ func (*binEndElement) size() int {
 func (e *binEndElement) append(b []byte) []byte {
 	b = appendU16(b, uint16(headerEndElement))
 	b = appendU16(b, 0x10) // chunk header size
-	b = appendU16(b, uint16(e.size()))
-	b = appendU16(b, 0)
+	b = appendU32(b, uint32(e.size()))
 	b = appendU32(b, uint32(e.line))
 	b = appendU32(b, 0xffffffff) // comment
 	if e.ns == nil {
@@ -634,8 +1309,7 @@ func (binStartNamspace) size() int {
 func (e binStartNamspace) append(b []byte) []byte {
 	b = appendU16(b, uint16(headerStartNamespace))
 	b = appendU16(b, 0x10) // chunk header size
-	b = appendU16(b, uint16(e.size()))
-	b = appendU16(b, 0)
+	b = appendU32(b, uint32(e.size()))
 	b = appendU32(b, uint32(e.line))
 	b = appendU32(b, 0xffffffff) // comment
 	b = appendU32(b, e.prefix.ind)
@@ -660,8 +1334,7 @@ func (binEndNamspace) size() int {
 func (e binEndNamspace) append(b []byte) []byte {
 	b = appendU16(b, uint16(headerEndNamespace))
 	b = appendU16(b, 0x10) // chunk header size
-	b = appendU16(b, uint16(e.size()))
-	b = appendU16(b, 0)
+	b = appendU32(b, uint32(e.size()))
 	b = appendU32(b, uint32(e.line))
 	b = appendU32(b, 0xffffffff) // comment
 	b = appendU32(b, e.prefix.ind)
@@ -2,10 +2,16 @@ package apk
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/xml"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"strings"
 	"testing"
+	"unicode/utf16"
 )
 
 var dump = flag.Bool("dump", false, "dump junk.bin binary output")
@@ -19,7 +25,7 @@ func TestBinaryXML(t *testing.T) {
 	sortPool, sortAttr = sortToMatchTest, sortAttrToMatchTest
 	defer func() { sortPool, sortAttr = origSortPool, origSortAttr }()
 
-	got, err := binaryXML(bytes.NewBufferString(input))
+	got, err := encode(t, input)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -35,7 +41,6 @@ func TestBinaryXML(t *testing.T) {
 		0x064c: true, // line number of CData off by one
 		0x06a0: true, // line number of fake </action> off by one
 		0x06f0: true, // line number of fake </category> off by one
-		0x0768: true, // line number of fake *end namespace* off by one
 	}
 
 	for i, o := range output {
@@ -49,6 +54,1135 @@ func TestBinaryXML(t *testing.T) {
 	}
 }
 
+func TestBinaryXMLDeterministic(t *testing.T) {
+	first, err := encode(t, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		got, err := encode(t, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, first) {
+			t.Fatalf("encoding %d differs from the first", i+2)
+		}
+	}
+}
+
+func TestBinaryXMLAttrOrder(t *testing.T) {
+	const manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example">
+	<application plain="1" android:theme="@android:style/Theme" android:label="L" android:name=".App" android:debuggable="false" />
+</manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := stringPool(got)
+	var names []string
+	for off := 8; off < len(got); {
+		typ := binary.LittleEndian.Uint16(got[off:])
+		size := int(binary.LittleEndian.Uint32(got[off+4:]))
+		if typ == headerStartElement && pool[binary.LittleEndian.Uint32(got[off+20:])] == "application" {
+			count := int(binary.LittleEndian.Uint16(got[off+28:]))
+			for i := 0; i < count; i++ {
+				a := got[off+36+20*i:]
+				names = append(names, pool[binary.LittleEndian.Uint32(a[4:])])
+			}
+		}
+		off += size
+	}
+	// label 0x01010001, theme 0x01010000, name 0x01010003, debuggable 0x0101000f
+	want := []string{"theme", "label", "name", "debuggable", "plain"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("attributes %q, want %q", names, want)
+	}
+}
+
+func TestBinaryXMLDuplicateAttr(t *testing.T) {
+	const dup = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example">
+	<application android:name="Foo" android:name="Bar" />
+</manifest>`
+	_, err := encode(t, dup)
+	if err == nil {
+		t.Fatal("expected error for duplicate attribute")
+	}
+	if got, want := err.Error(), "2: application: duplicate attribute name"; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+}
+
+func TestStringPoolSurrogates(t *testing.T) {
+	pool := new(binStringPool)
+	got := pool.get("a😀").enc // U+1F600 is D83D DE00 in UTF-16
+	want := []byte{
+		0x03, 0x00, // length in code units
+		0x61, 0x00,
+		0x3d, 0xd8, 0x00, 0xde,
+		0x00, 0x00,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("enc = % x, want % x", got, want)
+	}
+}
+
+func TestAttrValue(t *testing.T) {
+	tests := []struct {
+		name  string // android: attribute name
+		value string
+		typ   byte
+		data  uint32
+	}{
+		{"label", "@null", 0x00, 0},
+		{"label", "@empty", 0x00, 1},
+		{"required", "false", 0x12, 0},
+		{"required", "true", 0x12, 0xffffffff},
+		{"exported", "false", 0x12, 0},
+		{"targetSdkVersion", "31", 0x10, 31},
+		{"value", "42", 0x10, 42},
+		{"value", "-1", 0x10, 0xffffffff},
+		{"value", "0x2a", 0x11, 42},
+		{"value", "3", 0x10, 3},
+		{"value", "3.14", 0x04, math.Float32bits(3.14)},
+		{"value", "-1.5e3", 0x04, math.Float32bits(-1500)},
+		{"value", "NaN", 0x03, 2},
+		{"value", "false", 0x12, 0},
+		{"value", "balloon", 0x03, 2}, // pool index after the namespace and name
+		{"value", "#F00", 0x1f, 0xffff0000},
+		{"value", "#8F00", 0x1e, 0x88ff0000},
+		{"value", "#FF0000", 0x1d, 0xffff0000},
+		{"value", "#80FF0000", 0x1c, 0x80ff0000},
+		{"value", "#00000000", 0x1c, 0},
+		{"value", "#abc", 0x1f, 0xffaabbcc},
+		{"value", "#12345", 0x03, 2},
+		{"value", "#F0G", 0x03, 2},
+		{"value", "#", 0x03, 2},
+		{"anyDensity", "true", 0x12, 0xffffffff},
+		{"xlargeScreens", "false", 0x12, 0},
+		{"requiresSmallestWidthDp", "600", 0x10, 600},
+		{"screenSize", "large", 0x10, 400},
+		{"screenDensity", "xhdpi", 0x10, 320},
+		{"screenDensity", "280", 0x10, 280},
+		{"configChanges", "orientation|keyboardHidden", 0x11, 0xa0},
+		{"usesPermissionFlags", "neverForLocation", 0x11, 0x10000},
+		{"configChanges", "density|colorMode", 0x11, 0x5000},
+		{"foregroundServiceType", "mediaPlayback|dataSync", 0x11, 0x3},
+		{"foregroundServiceType", "camera|microphone|location", 0x11, 0xc8},
+		{"configChanges", "orientation|0x20000000", 0x11, 0x20000080},
+		{"configChanges", "orientation | keyboardHidden", 0x11, 0xa0},
+		{"configChanges", "orientation|010", 0x11, 0x8a},
+		{"glEsVersion", "0x00030000", 0x11, 0x30000},
+		{"glEsVersion", "0x00020001", 0x11, 0x20001},
+		{"glEsVersion", "0X00020000", 0x11, 0x20000},
+		{"glEsVersion", "00030000", 0x10, 30000},
+		{"glEsVersion", "196608", 0x10, 0x30000},
+		{"version", "2", 0x10, 2},
+		{"minWidth", "300dp", 0x05, 300<<8 | 1},
+		{"minHeight", "12.5sp", 0x05, 0x064000<<8 | 2<<4 | 2}, // 12.5 * 1<<15, in 8p15
+		{"minWidth", "-4px", 0x05, 0xfffffc << 8},
+		{"maxAspectRatio", "2.1", 0x04, math.Float32bits(2.1)},
+		{"maxRecents", "5", 0x10, 5},
+		{"sharedUserMaxSdkVersion", "32", 0x10, 32},
+		{"sharedUserId", "com.example.shared", 0x03, 2},
+		{"shell", "true", 0x12, 0xffffffff},
+		{"enabled", "false", 0x12, 0},
+		{"directBootAware", "true", 0x12, 0xffffffff},
+		{"allowBackup", "true", 0x12, 0xffffffff},
+		{"fullBackupContent", "false", 0x12, 0},
+		{"theme", "@android:style/Theme.NoTitleBar", 0x01, 0x01030006},
+		{"theme", "@android:style/Theme.Translucent.NoTitleBar.Fullscreen", 0x01, 0x01030011},
+		{"theme", "@android:style/Theme.Holo.Light.DarkActionBar", 0x01, 0x01030119},
+		{"theme", "@android:style/Theme.DeviceDefault", 0x01, 0x01030128},
+		{"theme", "@android:style/Theme.Material.Light.NoActionBar", 0x01, 0x01030240},
+		{"icon", "@android:drawable/sym_def_app_icon", 0x01, 0x01080093},
+	}
+	for _, test := range tests {
+		pool := new(binStringPool)
+		a, err := pool.getAttr(xml.Attr{
+			Name:  xml.Name{Space: androidSchema, Local: test.name},
+			Value: test.value,
+		})
+		if err != nil {
+			t.Errorf("%s=%q: %v", test.name, test.value, err)
+			continue
+		}
+		b := a.append(nil)
+		typ, data := b[15], binary.LittleEndian.Uint32(b[16:])
+		if typ != test.typ || data != test.data {
+			t.Errorf("%s=%q: type=0x%02x data=0x%x, want type=0x%02x data=0x%x", test.name, test.value, typ, data, test.typ, test.data)
+		}
+	}
+}
+
+func TestBinaryXMLClassNames(t *testing.T) {
+	const manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example">
+	<application android:name=".MyApp" android:label="App" android:appComponentFactory=".Factory">
+		<activity android:name="Main" />
+		<service android:name="org.other.Service" />
+		<meta-data android:name="Unqualified" android:value=".Value" />
+	</application>
+</manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"com.example.MyApp", "com.example.Factory", "com.example.Main", "org.other.Service", "Unqualified", ".Value"} {
+		if !bytes.Contains(got, poolString(s)) {
+			t.Errorf("missing string %q", s)
+		}
+	}
+	for _, s := range []string{".MyApp", ".Factory", "Main"} {
+		if bytes.Contains(got, poolString(s)) {
+			t.Errorf("unexpected string %q", s)
+		}
+	}
+	if !resourceMap(t, got)[0x0101057a] {
+		t.Error("resource map missing appComponentFactory")
+	}
+}
+
+// poolString returns the string pool encoding of s.
+func poolString(s string) []byte {
+	return new(binStringPool).get(s).enc
+}
+
+func TestBinaryXMLAttrs(t *testing.T) {
+	tests := []struct {
+		elem  string // element under <manifest>, or manifest itself
+		attr  string // qualified as in the source
+		value string
+		typ   byte
+		data  uint32 // unused for TYPE_STRING
+		str   string // pool string for TYPE_STRING
+		err   string
+	}{
+		{elem: "service", attr: "android:process", value: ":remote", typ: 0x03, str: ":remote"},
+		{elem: "service", attr: "android:permission", value: "com.example.BIND", typ: 0x03, str: "com.example.BIND"},
+		{elem: "provider", attr: "android:authorities", value: "com.example.files", typ: 0x03, str: "com.example.files"},
+		{elem: "provider", attr: "android:grantUriPermissions", value: "false", typ: 0x12, data: 0},
+		{elem: "grant-uri-permission", attr: "android:pathPrefix", value: "/shared/", typ: 0x03, str: "/shared/"},
+		{elem: "grant-uri-permission", attr: "android:pathPattern", value: `.*\.pdf`, typ: 0x03, str: `.*\.pdf`},
+		{elem: "path-permission", attr: "android:path", value: "/public", typ: 0x03, str: "/public"},
+		{elem: "path-permission", attr: "android:readPermission", value: "com.example.READ", typ: 0x03, str: "com.example.READ"},
+		{elem: "path-permission", attr: "android:writePermission", value: "com.example.WRITE", typ: 0x03, str: "com.example.WRITE"},
+		{elem: "uses-library", attr: "android:required", value: "false", typ: 0x12, data: 0},
+		{elem: "uses-native-library", attr: "android:required", value: "false", typ: 0x12, data: 0},
+		{elem: "application", attr: "android:icon", value: "@null", typ: 0x00, data: 0},
+		{elem: "application", attr: "android:roundIcon", value: "@null", typ: 0x00, data: 0},
+		{elem: "application", attr: "android:banner", value: "@null", typ: 0x00, data: 0},
+		{elem: "application", attr: "android:localeConfig", value: "@null", typ: 0x00, data: 0},
+		{elem: "application", attr: "android:networkSecurityConfig", value: "@null", typ: 0x00, data: 0},
+		{elem: "application", attr: "android:allowBackup", value: "true", typ: 0x12, data: 0xffffffff},
+		{elem: "application", attr: "android:backupAgent", value: ".Backup", typ: 0x03, str: "com.example.Backup"},
+		{elem: "application", attr: "android:fullBackupContent", value: "false", typ: 0x12, data: 0},
+		{elem: "application", attr: "android:dataExtractionRules", value: "@null", typ: 0x00, data: 0},
+		{elem: "application", attr: "android:icon", value: "@android:drawable/sym_def_app_icon", typ: 0x01, data: 0x01080093},
+		{elem: "application", attr: "android:roundIcon", value: "@android:drawable/sym_def_app_icon", typ: 0x01, data: 0x01080093},
+		{elem: "application", attr: "android:banner", value: "@android:drawable/sym_def_app_icon", typ: 0x01, data: 0x01080093},
+		{elem: "application", attr: "android:theme", value: "@android:style/Theme.Material", typ: 0x01, data: 0x01030224},
+		{elem: "application", attr: "android:icon", value: "@mipmap/ic_launcher", err: `icon: cannot resolve "@mipmap/ic_launcher": app resources are not compiled by this package`},
+		{elem: "application", attr: "android:roundIcon", value: "@mipmap/ic_launcher_round", err: `roundIcon: cannot resolve "@mipmap/ic_launcher_round": app resources are not compiled by this package`},
+		{elem: "application", attr: "android:banner", value: "@drawable/banner", err: `banner: cannot resolve "@drawable/banner": app resources are not compiled by this package`},
+		{elem: "application", attr: "android:localeConfig", value: "@xml/locales_config", err: `localeConfig: cannot resolve "@xml/locales_config": app resources are not compiled by this package`},
+		{elem: "application", attr: "android:networkSecurityConfig", value: "@xml/network_security_config", err: `networkSecurityConfig: cannot resolve "@xml/network_security_config": app resources are not compiled by this package`},
+		{elem: "application", attr: "android:fullBackupContent", value: "@xml/backup_rules", err: `fullBackupContent: cannot resolve "@xml/backup_rules": app resources are not compiled by this package`},
+		{elem: "application", attr: "android:dataExtractionRules", value: "@xml/data_extraction_rules", err: `dataExtractionRules: cannot resolve "@xml/data_extraction_rules": app resources are not compiled by this package`},
+		{elem: "supports-screens", attr: "android:smallScreens", value: "false", typ: 0x12, data: 0},
+		{elem: "supports-screens", attr: "android:largeScreens", value: "true", typ: 0x12, data: 0xffffffff},
+		{elem: "supports-screens", attr: "android:anyDensity", value: "true", typ: 0x12, data: 0xffffffff},
+		{elem: "supports-screens", attr: "android:requiresSmallestWidthDp", value: "600", typ: 0x10, data: 600},
+		{elem: "screen", attr: "android:screenSize", value: "large", typ: 0x10, data: 400},
+		{elem: "screen", attr: "android:screenDensity", value: "hdpi", typ: 0x10, data: 240},
+		{elem: "screen", attr: "android:screenSize", value: "huge", err: `screenSize: unknown value "huge"`},
+		{elem: "manifest", attr: "android:isFeatureSplit", value: "false", typ: 0x12, data: 0},
+		{elem: "manifest", attr: "split", value: "config.arm64_v8a", typ: 0x03, str: "config.arm64_v8a"},
+		{elem: "manifest", attr: "configForSplit", value: "feature", typ: 0x03, str: "feature"},
+		{elem: "manifest", attr: "android:sharedUserId", value: "com.example.shared", typ: 0x03, str: "com.example.shared"},
+		{elem: "manifest", attr: "android:sharedUserMaxSdkVersion", value: "32", typ: 0x10, data: 32},
+		{elem: "uses-feature", attr: "android:glEsVersion", value: "0x00030000", typ: 0x11, data: 0x30000},
+		{elem: "uses-feature", attr: "android:glEsVersion", value: "196608", typ: 0x10, data: 0x30000},
+		{elem: "uses-feature", attr: "android:required", value: "true", typ: 0x12, data: 0xffffffff},
+		{elem: "uses-feature", attr: "android:name", value: "android.hardware.camera", typ: 0x03, str: "android.hardware.camera"},
+		{elem: "uses-feature", attr: "android:version", value: "4198400", typ: 0x10, data: 4198400},
+		{elem: "profileable", attr: "android:shell", value: "true", typ: 0x12, data: 0xffffffff},
+		{elem: "profileable", attr: "android:enabled", value: "true", typ: 0x12, data: 0xffffffff},
+		{elem: "receiver", attr: "android:directBootAware", value: "true", typ: 0x12, data: 0xffffffff},
+		{elem: "receiver", attr: "android:enabled", value: "false", typ: 0x12, data: 0},
+		{elem: "activity", attr: "android:maxAspectRatio", value: "2.1", typ: 0x04, data: math.Float32bits(2.1)},
+		{elem: "activity", attr: "android:maxRecents", value: "5", typ: 0x10, data: 5},
+		{elem: "layout", attr: "android:minWidth", value: "300dp", typ: 0x05, data: 300<<8 | 1},
+		{elem: "layout", attr: "android:minHeight", value: "200dp", typ: 0x05, data: 200<<8 | 1},
+	}
+	for _, test := range tests {
+		attr := test.attr + `="` + test.value + `"`
+		var manifest string
+		if test.elem == "manifest" {
+			manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example" ` + attr + ` />`
+		} else {
+			manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example">
+	<` + test.elem + ` ` + attr + ` />
+</manifest>`
+		}
+		got, err := encode(t, manifest)
+		if test.err != "" {
+			if err == nil || !strings.HasSuffix(err.Error(), test.err) {
+				t.Errorf("<%s %s>: error %v, want %q", test.elem, attr, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("<%s %s>: %v", test.elem, attr, err)
+			continue
+		}
+
+		local := test.attr[strings.Index(test.attr, ":")+1:]
+		id, typ, data := findAttr(t, got, test.elem, local)
+		wantID := uint32(0)
+		if strings.HasPrefix(test.attr, "android:") {
+			wantID = resourceCodes[local]
+		}
+		if id != wantID {
+			t.Errorf("<%s %s>: resource ID 0x%08x, want 0x%08x", test.elem, attr, id, wantID)
+		}
+		if typ != test.typ {
+			t.Errorf("<%s %s>: type 0x%02x, want 0x%02x", test.elem, attr, typ, test.typ)
+			continue
+		}
+		if typ == 0x03 {
+			if s := stringPool(got)[data]; s != test.str {
+				t.Errorf("<%s %s>: string %q, want %q", test.elem, attr, s, test.str)
+			}
+		} else if data != test.data {
+			t.Errorf("<%s %s>: data 0x%x, want 0x%x", test.elem, attr, data, test.data)
+		}
+	}
+}
+
+// findAttr returns the resource ID, Res_value type and data of the
+// attribute name on the first element elem in the binary XML b. The ID
+// is zero if the attribute name is not in the resource map.
+func findAttr(t *testing.T, b []byte, elem, name string) (id uint32, typ byte, data uint32) {
+	t.Helper()
+	pool := stringPool(b)
+	poolSize := int(binary.LittleEndian.Uint32(b[8+4:]))
+	var ids []uint32
+	if m := b[8+poolSize:]; binary.LittleEndian.Uint16(m) == headerResourceMap {
+		size := int(binary.LittleEndian.Uint32(m[4:]))
+		for i := 8; i < size; i += 4 {
+			ids = append(ids, binary.LittleEndian.Uint32(m[i:]))
+		}
+	}
+	for off := 8; off < len(b); {
+		typ := binary.LittleEndian.Uint16(b[off:])
+		size := int(binary.LittleEndian.Uint32(b[off+4:]))
+		if typ == headerStartElement && pool[binary.LittleEndian.Uint32(b[off+20:])] == elem {
+			count := int(binary.LittleEndian.Uint16(b[off+28:]))
+			for i := 0; i < count; i++ {
+				a := b[off+36+20*i:]
+				ind := binary.LittleEndian.Uint32(a[4:])
+				if pool[ind] != name {
+					continue
+				}
+				if int(ind) < len(ids) {
+					id = ids[ind]
+				}
+				return id, a[15], binary.LittleEndian.Uint32(a[16:])
+			}
+			t.Fatalf("<%s> has no attribute %s", elem, name)
+		}
+		off += size
+	}
+	t.Fatalf("no element <%s>", elem)
+	return 0, 0, 0
+}
+
+// resourceMap returns the resource IDs in the binary XML b.
+func resourceMap(t *testing.T, b []byte) map[uint32]bool {
+	poolSize := int(binary.LittleEndian.Uint32(b[8+4:]))
+	m := b[8+poolSize:]
+	if typ := binary.LittleEndian.Uint16(m); typ != headerResourceMap {
+		t.Fatalf("chunk after string pool has type 0x%04x, want resource map", typ)
+	}
+	size := int(binary.LittleEndian.Uint32(m[4:]))
+	ids := make(map[uint32]bool)
+	for i := 8; i < size; i += 4 {
+		ids[binary.LittleEndian.Uint32(m[i:])] = true
+	}
+	return ids
+}
+
+// stringPool returns the strings in the pool of the binary XML b.
+func stringPool(b []byte) []string {
+	p := b[8:]
+	count := int(binary.LittleEndian.Uint32(p[8:]))
+	start := int(binary.LittleEndian.Uint32(p[20:]))
+	strs := make([]string, count)
+	for i := range strs {
+		off := start + int(binary.LittleEndian.Uint32(p[0x1c+4*i:]))
+		n := int(binary.LittleEndian.Uint16(p[off:]))
+		u := make([]uint16, n)
+		for j := range u {
+			u[j] = binary.LittleEndian.Uint16(p[off+2+2*j:])
+		}
+		strs[i] = string(utf16.Decode(u))
+	}
+	return strs
+}
+
+func TestBinaryXMLLarge(t *testing.T) {
+	// A string pool over 64KB needs the full 32-bit chunk size.
+	manifest := `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example"><application>`
+	for i := 0; i < 2000; i++ {
+		manifest += fmt.Sprintf(`<meta-data android:name="com.example.key%04d" android:value="value%04d" />`, i, i)
+	}
+	manifest += `</application></manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := binary.LittleEndian.Uint32(got[4:]); int(size) != len(got) {
+		t.Errorf("file size = %d, want %d", size, len(got))
+	}
+	if size := binary.LittleEndian.Uint32(got[8+4:]); size < 1<<16 {
+		t.Errorf("string pool size = %d, want over 64KB", size)
+	}
+}
+
+func BenchmarkBinaryXML(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := binaryXML(bytes.NewBufferString(input), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBinaryXMLNoAndroidAttrs(t *testing.T) {
+	const manifest = `<manifest package="com.example"><application/></manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := binary.LittleEndian.Uint32(got[4:]); int(size) != len(got) {
+		t.Errorf("file size = %d, want %d", size, len(got))
+	}
+	poolSize := int(binary.LittleEndian.Uint32(got[8+4:]))
+	if typ := binary.LittleEndian.Uint16(got[8+poolSize:]); typ != headerStartElement {
+		t.Errorf("chunk after string pool has type 0x%04x, want start element", typ)
+	}
+}
+
+func TestBinaryXMLExported(t *testing.T) {
+	const tmpl = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example">
+	<uses-sdk android:minSdkVersion="21" android:targetSdkVersion="%d" />
+	<application>
+		<activity android:name=".Main"%s>
+			<intent-filter>
+				<action android:name="android.intent.action.MAIN" />
+			</intent-filter>
+		</activity>
+		<service android:name=".NoFilter" />
+	</application>
+</manifest>`
+	tests := []struct {
+		targetSdk int
+		attr      string
+		wantErr   bool
+	}{
+		{30, "", false},
+		{31, "", true},
+		{31, ` android:exported="true"`, false},
+		{34, ` android:exported="false"`, false},
+	}
+	for _, test := range tests {
+		manifest := fmt.Sprintf(tmpl, test.targetSdk, test.attr)
+		_, err := encode(t, manifest)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("targetSdkVersion=%d attr=%q: err=%v, want error %v", test.targetSdk, test.attr, err, test.wantErr)
+		}
+	}
+
+	// The SDK level is known only at the end of the manifest. Without
+	// a targetSdkVersion it is the minSdkVersion.
+	const late = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example">
+	<application>
+		<activity android:name=".Main">
+			<intent-filter>
+				<action android:name="android.intent.action.MAIN" />
+			</intent-filter>
+		</activity>
+	</application>
+	<uses-sdk %s />
+</manifest>`
+	lateTests := []struct {
+		usesSdk string
+		wantErr bool
+	}{
+		{`android:targetSdkVersion="31"`, true},
+		{`android:minSdkVersion="31"`, true},
+		{`android:minSdkVersion="31" android:targetSdkVersion="30"`, false},
+		{`android:minSdkVersion="21"`, false},
+	}
+	for _, test := range lateTests {
+		_, err := encode(t, fmt.Sprintf(late, test.usesSdk))
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("late <uses-sdk %s>: err=%v, want error %v", test.usesSdk, err, test.wantErr)
+		}
+	}
+}
+
+func TestBinaryXMLAttrNamespace(t *testing.T) {
+	const manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example">
+	<application android:name=".App" name="plain" path="p" version="1" />
+</manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := resourceMap(t, got)
+	if len(ids) != 1 || !ids[resourceCodes["name"]] {
+		t.Errorf("resource map = %v, want only name", ids)
+	}
+	if n := bytes.Count(got, poolString("name")); n != 2 {
+		t.Errorf("pool has %d copies of name, want 2", n)
+	}
+}
+
+func TestBinaryXMLTools(t *testing.T) {
+	const manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android"
+	xmlns:tools="http://schemas.android.com/tools"
+	package="com.example">
+	<uses-sdk android:minSdkVersion="21" tools:overrideLibrary="com.example.lib" />
+	<uses-permission android:name="android.permission.READ_PHONE_STATE" tools:node="remove">
+		<nested android:name="com.example.Nested" />
+	</uses-permission>
+	<application android:label="Mine" tools:replace="android:label" />
+</manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{toolsSchema, "tools", "replace", "android:label", "overrideLibrary", "com.example.lib", "uses-permission", "android.permission.READ_PHONE_STATE", "com.example.Nested"} {
+		if bytes.Contains(got, poolString(s)) {
+			t.Errorf("unexpected string %q", s)
+		}
+	}
+	if !bytes.Contains(got, poolString("Mine")) {
+		t.Error(`missing label "Mine"`)
+	}
+}
+
+func TestBinaryXMLLineNumbers(t *testing.T) {
+	got, err := encode(t, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lines of the start elements in input, which begins with an XML
+	// declaration and a multi-line comment.
+	want := []uint32{7, 13, 14, 15, 18, 19, 21, 22}
+	var lines []uint32
+	for _, n := range xmlNodes(t, got) {
+		if n.typ == headerStartElement {
+			lines = append(lines, n.line)
+		}
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("start element lines = %v, want %v", lines, want)
+	}
+}
+
+type xmlNode struct {
+	typ  uint16
+	line uint32
+}
+
+// xmlNodes returns the XML tree chunks of the binary XML b, in order.
+func xmlNodes(t *testing.T, b []byte) []xmlNode {
+	var nodes []xmlNode
+	for off := 8; off < len(b); {
+		typ := binary.LittleEndian.Uint16(b[off:])
+		size := int(binary.LittleEndian.Uint32(b[off+4:]))
+		if size < 8 || off+size > len(b) {
+			t.Fatalf("chunk at 0x%04x has bad size %d", off, size)
+		}
+		if typ >= headerStartNamespace && typ <= headerCharData {
+			nodes = append(nodes, xmlNode{typ: typ, line: binary.LittleEndian.Uint32(b[off+8:])})
+		}
+		off += size
+	}
+	return nodes
+}
+
+func TestValidateBinaryXML(t *testing.T) {
+	b, err := binaryXML(bytes.NewBufferString(input), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateBinaryXML(b); err != nil {
+		t.Fatalf("valid output rejected: %v", err)
+	}
+
+	corrupt := []struct {
+		name string
+		edit func(b []byte) []byte
+	}{
+		{"truncated", func(b []byte) []byte { return b[:len(b)-4] }},
+		{"bad file size", func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[4:], uint32(len(b)+4))
+			return b
+		}},
+		{"missing end element", func(b []byte) []byte {
+			// The last two chunks are </manifest> and END_NAMESPACE.
+			b = b[:len(b)-0x18-0x18]
+			binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+			return b
+		}},
+		{"Res_value size", func(b []byte) []byte {
+			// The size of the first INT_DEC value, android:versionCode.
+			i := bytes.Index(b, []byte{0x08, 0x00, 0x00, 0x10})
+			b[i] = 0
+			return b
+		}},
+		{"string index out of range", func(b []byte) []byte {
+			// The name of the final END_NAMESPACE's uri.
+			binary.LittleEndian.PutUint32(b[len(b)-4:], 0xfffff)
+			return b
+		}},
+		{"short string pool header", func(b []byte) []byte {
+			b = b[:16]
+			binary.LittleEndian.PutUint32(b[4:], 16)
+			binary.LittleEndian.PutUint16(b[10:], 8) // header size
+			binary.LittleEndian.PutUint32(b[12:], 8) // size
+			return b
+		}},
+		{"short start element", func(b []byte) []byte {
+			// Cut the first START_ELEMENT down to its node header
+			// and the first 8 bytes of its attribute extension.
+			i := bytes.Index(b, []byte{0x02, 0x01, 0x10, 0x00})
+			b = b[:i+24]
+			binary.LittleEndian.PutUint32(b[i+4:], 24)
+			binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+			return b
+		}},
+	}
+	for _, c := range corrupt {
+		bad := c.edit(append([]byte(nil), b...))
+		if err := validateBinaryXML(bad); err == nil {
+			t.Errorf("%s: corrupt output accepted", c.name)
+		}
+	}
+}
+
+// encode encodes manifest to binary XML. Output is checked with
+// validateBinaryXML, so every manifest the tests encode must be one
+// Android could load.
+func encode(t *testing.T, manifest string) ([]byte, error) {
+	t.Helper()
+	b, err := binaryXML(bytes.NewBufferString(manifest), false)
+	if err == nil {
+		if err := validateBinaryXML(b); err != nil {
+			t.Fatalf("invalid binary XML: %v", err)
+		}
+	}
+	return b, err
+}
+
+// validateBinaryXML checks b is structurally sound binary XML, in the
+// way ResXMLTree::setTo in AOSP does when it loads a file. The chunk
+// sizes must add up, every string reference must be in the string pool,
+// and element and namespace chunks must be balanced.
+func validateBinaryXML(b []byte) error {
+	u16 := func(off int) uint16 { return uint16(b[off]) | uint16(b[off+1])<<8 }
+	u32 := func(off int) uint32 { return uint32(u16(off)) | uint32(u16(off+2))<<16 }
+
+	if len(b) < 8 || headerType(u16(0)) != headerXML || u16(2) != 8 {
+		return fmt.Errorf("missing XML header")
+	}
+	if int(u32(4)) != len(b) {
+		return fmt.Errorf("XML chunk size %d, file size %d", u32(4), len(b))
+	}
+
+	nstrings := -1 // string count, once the pool is read
+	str := func(off int, optional bool) error {
+		i := u32(off)
+		if optional && i == 0xffffffff {
+			return nil
+		}
+		if int(i) >= nstrings {
+			return fmt.Errorf("string index %d at 0x%x out of range", i, off)
+		}
+		return nil
+	}
+	var elements, namespaces []uint32
+
+	for off := 8; off < len(b); {
+		if off+8 > len(b) {
+			return fmt.Errorf("truncated chunk at 0x%x", off)
+		}
+		typ, hsize, size := u16(off), int(u16(off+2)), int(u32(off+4))
+		if hsize < 8 || size < hsize || size%4 != 0 || off+size > len(b) {
+			return fmt.Errorf("chunk at 0x%x has header size %d, size %d", off, hsize, size)
+		}
+		if nstrings < 0 && typ != headerStringPool {
+			return fmt.Errorf("chunk at 0x%x precedes the string pool", off)
+		}
+		if typ >= headerStartNamespace && typ <= headerCharData {
+			if hsize != 0x10 || size < hsize+8 || typ == headerStartElement && size < hsize+20 {
+				return fmt.Errorf("node at 0x%x has header size %d, size %d", off, hsize, size)
+			}
+			if err := str(off+12, true); err != nil { // comment
+				return err
+			}
+		}
+		ext := off + hsize
+		switch typ {
+		case headerStringPool:
+			if nstrings >= 0 {
+				return fmt.Errorf("second string pool at 0x%x", off)
+			}
+			if hsize != 0x1c {
+				return fmt.Errorf("string pool at 0x%x has header size %d", off, hsize)
+			}
+			nstrings = int(u32(off + 8))
+			start := int(u32(off + 20))
+			if hsize+4*nstrings > size || start > size {
+				return fmt.Errorf("string pool at 0x%x has %d nstrings, size %d", off, nstrings, size)
+			}
+			for i := 0; i < nstrings; i++ {
+				if start+int(u32(off+hsize+4*i))+2 > size {
+					return fmt.Errorf("string %d outside the string pool", i)
+				}
+			}
+		case headerResourceMap:
+			if n := (size - hsize) / 4; n > nstrings {
+				return fmt.Errorf("resource map has %d entries for %d nstrings", n, nstrings)
+			}
+		case headerStartNamespace, headerEndNamespace:
+			if err := str(ext, false); err != nil { // prefix
+				return err
+			}
+			if err := str(ext+4, false); err != nil { // uri
+				return err
+			}
+			if typ == headerStartNamespace {
+				namespaces = append(namespaces, u32(ext+4))
+				break
+			}
+			if n := len(namespaces); n == 0 || namespaces[n-1] != u32(ext+4) {
+				return fmt.Errorf("unbalanced end namespace at 0x%x", off)
+			}
+			namespaces = namespaces[:len(namespaces)-1]
+		case headerStartElement:
+			if err := str(ext, true); err != nil { // ns
+				return err
+			}
+			if err := str(ext+4, false); err != nil { // name
+				return err
+			}
+			start, asize, count := int(u16(ext+8)), int(u16(ext+10)), int(u16(ext+12))
+			if asize < 20 || ext+start+asize*count > off+size {
+				return fmt.Errorf("attributes of element at 0x%x overrun it", off)
+			}
+			for i := 0; i < count; i++ {
+				a := ext + start + asize*i
+				if err := str(a, true); err != nil { // ns
+					return err
+				}
+				if err := str(a+4, false); err != nil { // name
+					return err
+				}
+				if err := str(a+8, true); err != nil { // raw value
+					return err
+				}
+				if vsize := u16(a + 12); vsize != resValueSize {
+					return fmt.Errorf("attribute value at 0x%x has size %d", a+12, vsize)
+				}
+				if b[a+15] == 0x03 { // STRING
+					if err := str(a+16, false); err != nil {
+						return err
+					}
+				}
+			}
+			elements = append(elements, u32(ext+4))
+		case headerEndElement:
+			if err := str(ext+4, false); err != nil { // name
+				return err
+			}
+			if n := len(elements); n == 0 || elements[n-1] != u32(ext+4) {
+				return fmt.Errorf("unbalanced end element at 0x%x", off)
+			}
+			elements = elements[:len(elements)-1]
+		case headerCharData:
+			if err := str(ext, false); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown chunk type 0x%04x at 0x%x", typ, off)
+		}
+		off += size
+	}
+	if len(elements) > 0 || len(namespaces) > 0 {
+		return fmt.Errorf("%d elements and %d namespaces not closed", len(elements), len(namespaces))
+	}
+	return nil
+}
+
+func TestBinaryXMLNamespaceEnds(t *testing.T) {
+	// In the golden output the END_NAMESPACE chunk is last, at 0x760,
+	// after the END_ELEMENT of <manifest>.
+	nodes := xmlNodes(t, output)
+	if n := len(nodes); nodes[n-2].typ != headerEndElement || nodes[n-1].typ != headerEndNamespace {
+		t.Fatalf("golden output does not end with END_ELEMENT, END_NAMESPACE")
+	}
+
+	const manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android"
+	xmlns:dist="http://schemas.android.com/apk/distribution" package="com.example">
+	<application xmlns:app="http://schemas.android.com/apk/res-auto" />
+</manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var typs []uint16
+	for _, n := range xmlNodes(t, got) {
+		typs = append(typs, n.typ)
+	}
+	want := []uint16{
+		headerStartNamespace, // android
+		headerStartNamespace, // dist
+		headerStartElement,   // manifest
+		headerStartNamespace, // app
+		headerStartElement,   // application
+		headerEndElement,     // application
+		headerEndNamespace,   // app
+		headerEndElement,     // manifest
+		headerEndNamespace,   // dist
+		headerEndNamespace,   // android
+	}
+	if fmt.Sprint(typs) != fmt.Sprint(want) {
+		t.Errorf("chunk types %x, want %x", typs, want)
+	}
+}
+
+// TestReferenceValue checks a reference and an INT_HEX holding the same
+// resource ID differ only in the Res_value type.
+func TestReferenceValue(t *testing.T) {
+	const id = 0x7f0d0000 // the first mipmap aapt would allocate
+	name := new(binStringPool).get("icon")
+	ref := (&binAttr{name: name, data: reference(id)}).append(nil)
+	hex := (&binAttr{name: name, data: uint32(id)}).append(nil)
+	if len(ref) != len(hex) {
+		t.Fatalf("reference is %d bytes, INT_HEX is %d", len(ref), len(hex))
+	}
+	for i := range ref {
+		if i == 15 {
+			continue
+		}
+		if ref[i] != hex[i] {
+			t.Errorf("byte %d: reference 0x%02x, INT_HEX 0x%02x", i, ref[i], hex[i])
+		}
+	}
+	if ref[15] != 0x01 || hex[15] != 0x11 {
+		t.Errorf("types 0x%02x and 0x%02x, want 0x01 and 0x11", ref[15], hex[15])
+	}
+	if got := binary.LittleEndian.Uint32(ref[16:]); got != id {
+		t.Errorf("reference data 0x%x, want 0x%x", got, id)
+	}
+
+	// glEsVersion keeps the form it was written in.
+	var gles [2][]byte
+	for i, v := range []string{"0x00020000", "131072"} {
+		a, err := new(binStringPool).getAttr(xml.Attr{
+			Name:  xml.Name{Space: androidSchema, Local: "glEsVersion"},
+			Value: v,
+		})
+		if err != nil {
+			t.Fatalf("glEsVersion=%q: %v", v, err)
+		}
+		gles[i] = a.append(nil)
+	}
+	if gles[0][15] != 0x11 || gles[1][15] != 0x10 {
+		t.Errorf("glEsVersion types 0x%02x and 0x%02x, want 0x11 and 0x10", gles[0][15], gles[1][15])
+	}
+	if !bytes.Equal(gles[0][16:], gles[1][16:]) {
+		t.Errorf("glEsVersion data % x and % x differ", gles[0][16:], gles[1][16:])
+	}
+}
+
+func TestBinaryXMLNoManifest(t *testing.T) {
+	tests := []struct {
+		name, input, err string
+	}{
+		{"empty", "", "no manifest root element found"},
+		{"whitespace", "\n\t \n", "no manifest root element found"},
+		{"comments", "<?xml version=\"1.0\"?>\n<!-- nothing -->\n<!-- here -->\n", "no manifest root element found"},
+		{"other root", "<application/>", "1: root element is <application>, want <manifest>"},
+		{"two roots", "<manifest package=\"com.a\"/>\n<manifest package=\"com.b\"/>", "2: second root element <manifest>"},
+	}
+	for _, test := range tests {
+		_, err := encode(t, test.input)
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%s: error %q, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+// TestBinaryXMLAssetPack encodes the manifest of an install-time asset
+// pack split, as bundletool generates it.
+func TestBinaryXMLAssetPack(t *testing.T) {
+	const manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android"
+	xmlns:dist="http://schemas.android.com/apk/distribution"
+	package="com.example.game" split="textures">
+	<dist:module dist:type="asset-pack">
+		<dist:fusing dist:include="true" />
+		<dist:delivery>
+			<dist:install-time />
+		</dist:delivery>
+	</dist:module>
+	<application android:hasCode="false" />
+</manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"http://schemas.android.com/apk/distribution", "asset-pack", "install-time", "textures"} {
+		if !bytes.Contains(got, poolString(s)) {
+			t.Errorf("missing string %q", s)
+		}
+	}
+}
+
+func TestBinaryXMLNamespacePrefix(t *testing.T) {
+	// The android namespace is recognized by its URI, whatever the prefix.
+	const manifest = `<manifest xmlns:a="http://schemas.android.com/apk/res/android" package="com.example" a:versionCode="7">
+	<application a:name=".App" a:hasCode="false" />
+</manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := resourceMap(t, got)
+	for _, name := range []string{"versionCode", "name", "hasCode"} {
+		if !ids[resourceCodes[name]] {
+			t.Errorf("resource map missing %s", name)
+		}
+	}
+	for _, s := range []string{"a", "com.example.App"} {
+		if !bytes.Contains(got, poolString(s)) {
+			t.Errorf("missing string %q", s)
+		}
+	}
+	for _, s := range []string{"android", "7", "false"} {
+		if bytes.Contains(got, poolString(s)) {
+			t.Errorf("unexpected string %q", s)
+		}
+	}
+}
+
+func TestBinaryXMLBareUsesSdk(t *testing.T) {
+	// Without minSdkVersion, Android assumes 1.
+	const manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example">
+	<uses-sdk/>
+</manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := bytes.Index(got, poolString("uses-sdk"))
+	if off < 0 {
+		t.Fatal("missing uses-sdk")
+	}
+	nodes := xmlNodes(t, got)
+	if len(nodes) != 6 || nodes[2].typ != headerStartElement || nodes[3].typ != headerEndElement {
+		t.Fatalf("unexpected chunks %v", nodes)
+	}
+	// The START_ELEMENT of <uses-sdk> is the second, and its attribute
+	// count, after the 0x10 header and four fields, must be 0.
+	var start []int
+	for o := 8; o < len(got); {
+		typ := binary.LittleEndian.Uint16(got[o:])
+		if typ == headerStartElement {
+			start = append(start, o)
+		}
+		o += int(binary.LittleEndian.Uint32(got[o+4:]))
+	}
+	if n := binary.LittleEndian.Uint16(got[start[1]+0x10+12:]); n != 0 {
+		t.Errorf("uses-sdk has %d attributes, want 0", n)
+	}
+}
+
+func TestBinaryXMLCharData(t *testing.T) {
+	// The decoder returns the text of <label> as four tokens.
+	const manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example">
+	<label>one <![CDATA[<two>]]> three<!-- comment --> &amp; four</label>
+</manifest>`
+	got, err := encode(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdata := 0
+	for _, n := range xmlNodes(t, got) {
+		if n.typ == headerCharData {
+			cdata++
+		}
+	}
+	if cdata != 1 {
+		t.Errorf("%d CDATA chunks, want 1", cdata)
+	}
+	if want := "one <two> three & four"; !bytes.Contains(got, poolString(want)) {
+		t.Errorf("missing string %q", want)
+	}
+}
+
+func BenchmarkStringPool(b *testing.B) {
+	strs := []string{"android.intent.action.MAIN", "com.example.MainActivity", "Hello, 世界", "emoji 😀"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pool := new(binStringPool)
+		for _, s := range strs {
+			pool.get(s)
+		}
+	}
+}
+
+// TestResourceCodes checks resource IDs against the decimal values
+// listed in the android.R.attr documentation.
+func TestResourceCodes(t *testing.T) {
+	tests := map[string]uint32{
+		"label":                 16842753,
+		"name":                  16842755,
+		"debuggable":            16842767,
+		"minSdkVersion":         16843276,
+		"versionCode":           16843291,
+		"foregroundServiceType": 16844191,
+	}
+	for name, want := range tests {
+		if got := resourceCodes[name]; got != want {
+			t.Errorf("%s: resource ID 0x%08x, want 0x%08x", name, got, want)
+		}
+	}
+}
+
+func TestAttrValueUnknownFlag(t *testing.T) {
+	_, err := new(binStringPool).getAttr(xml.Attr{
+		Name:  xml.Name{Space: androidSchema, Local: "configChanges"},
+		Value: "orientation|orientaton",
+	})
+	if err == nil {
+		t.Fatal("misspelled configChanges flag accepted")
+	}
+	if want := `configChanges: unknown flag "orientaton"`; err.Error() != want {
+		t.Errorf("error %q, want %q", err, want)
+	}
+}
+
+func TestAttrValueUnresolved(t *testing.T) {
+	tests := []struct {
+		name  string // android: attribute name
+		value string
+		err   string
+	}{
+		{"theme", "@style/AppTheme", `theme: cannot resolve "@style/AppTheme": app resources are not compiled by this package`},
+		{"icon", "@mipmap/ic_launcher", `icon: cannot resolve "@mipmap/ic_launcher": app resources are not compiled by this package`},
+		{"label", "@string/app_name", `label: cannot resolve "@string/app_name": app resources are not compiled by this package`},
+		{"fullBackupContent", "@xml/backup_rules", `fullBackupContent: cannot resolve "@xml/backup_rules": app resources are not compiled by this package`},
+		{"networkSecurityConfig", "@xml/network_security_config", `networkSecurityConfig: cannot resolve "@xml/network_security_config": app resources are not compiled by this package`},
+		{"theme", "@android:style/Theme.Nonexistent", `theme: unknown framework resource "@android:style/Theme.Nonexistent"`},
+		{"icon", "@android:mipmap/sym_def_app_icon", `icon: unknown framework resource "@android:mipmap/sym_def_app_icon"`},
+	}
+	for _, test := range tests {
+		_, err := new(binStringPool).getAttr(xml.Attr{
+			Name:  xml.Name{Space: androidSchema, Local: test.name},
+			Value: test.value,
+		})
+		if err == nil {
+			t.Errorf("%s=%q accepted", test.name, test.value)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%s=%q: error %q, want %q", test.name, test.value, err, test.err)
+		}
+	}
+}
+
+func TestBinaryXMLSyntaxError(t *testing.T) {
+	const manifest = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.example">
+	<application android:label="Tom &amp; Jerry" />
+	<application android:label="&copy; 2015" />
+</manifest>`
+	_, err := encode(t, manifest)
+	if err == nil {
+		t.Fatal("undefined entity accepted")
+	}
+	if want := "3: invalid character entity &copy;"; err.Error() != want {
+		t.Errorf("error %q, want %q", err, want)
+	}
+}
+
+func TestBinaryXMLPackageName(t *testing.T) {
+	tests := []struct {
+		pkg, err string
+	}{
+		{"com.example", ""},
+		{"com.example.game_2", ""},
+		{"org.Golang.X", ""},
+		{"a.b", ""},
+		{"example", "must have at least one '.' separator"},
+		{"com.1foo", `segment "1foo" does not start with a letter`},
+		{"com..bar", "empty segment"},
+		{".com.example", "empty segment"},
+		{"com.example.", "empty segment"},
+		{"com._foo", `segment "_foo" does not start with a letter`},
+		{"com.foo-bar", `segment "foo-bar" contains bad character '-'`},
+		{"com.exämple", `segment "exämple" contains bad character 'ä'`},
+		{"com.new.app", `segment "new" is a Java reserved word`},
+	}
+	for _, test := range tests {
+		manifest := `<manifest package="` + test.pkg + `"/>`
+		_, err := encode(t, manifest)
+		want := ""
+		if test.err != "" {
+			want = fmt.Sprintf("1: invalid package name %q: %s", test.pkg, test.err)
+		}
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != want {
+			t.Errorf("%s: error %q, want %q", test.pkg, got, want)
+		}
+	}
+}
+
+func TestManifestReader(t *testing.T) {
+	want, err := encode(t, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, n, err := ManifestReader(bytes.NewBufferString(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(got) {
+		t.Errorf("length %d, read %d bytes", n, len(got))
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("ManifestReader output differs from binaryXML")
+	}
+
+	if _, _, err := ManifestReader(bytes.NewBufferString("<application/>")); err == nil {
+		t.Error("manifest without <manifest> root accepted")
+	}
+}
+
 // The output of the Android encoder seems to be arbitrary. So for testing,
 // we sort the string pool order to match the output we have seen.
 func sortToMatchTest(p *binStringPool) {
@@ -87,22 +1221,27 @@ func sortToMatchTest(p *binStringPool) {
 	}
 
 	s := make([]*bstring, 0)
-	m := make(map[string]*bstring)
+	m := make(map[poolKey]*bstring)
 
 	for _, str := range names {
-		bstr := p.m[str]
+		key := poolKey{str, resourceCodes[str]}
+		bstr := p.m[key]
+		if bstr == nil {
+			key.id = 0
+			bstr = p.m[key]
+		}
 		if bstr == nil {
 			log.Printf("missing %q", str)
 			continue
 		}
 		bstr.ind = uint32(len(s))
 		s = append(s, bstr)
-		m[str] = bstr
-		delete(p.m, str)
+		m[key] = bstr
+		delete(p.m, key)
 	}
 	// add unexpected strings
-	for str, bstr := range p.m {
-		log.Printf("unexpected %q", str)
+	for key, bstr := range p.m {
+		log.Printf("unexpected %q", key.str)
 		bstr.ind = uint32(len(s))
 		s = append(s, bstr)
 	}
@@ -1,17 +1,115 @@
 package apk
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"math/big"
 	"time"
 )
 
+// LoadSigningKey reads the RSA private key used by NewWriter from the
+// file at path. The format is detected from the file contents.
+//
+// The key may be PKCS#1 or PKCS#8, either DER or PEM encoded. Other PEM
+// blocks, such as certificates, are skipped: the Writer signs with a
+// self-signed certificate made from the key. Encrypted PEM keys are not
+// supported, and neither are keys other than RSA.
+//
+// Java keystores (JKS) and PKCS#12 files are recognized, but their
+// contents cannot be decoded yet. For these an error describing how to
+// convert the key to PEM is returned. DER encoded EC keys are reported
+// as such, and other DER data as unrecognized.
+func LoadSigningKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("apk: %v", err)
+	}
+	if bytes.HasPrefix(data, []byte{0xfe, 0xed, 0xfe, 0xed}) {
+		return nil, fmt.Errorf("apk: %s: JKS keystores are not supported, convert to PKCS#12 with keytool -importkeystore and then to PEM with openssl pkcs12 -nodes", path)
+	}
+	if len(data) > 0 && data[0] == 0x30 { // DER SEQUENCE
+		if key, err := x509.ParsePKCS1PrivateKey(data); err == nil {
+			return key, nil
+		}
+		if k, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+			key, err := rsaKey(k)
+			if err != nil {
+				return nil, fmt.Errorf("apk: %s: %v", path, err)
+			}
+			return key, nil
+		}
+		if _, err := x509.ParseECPrivateKey(data); err == nil {
+			return nil, fmt.Errorf("apk: %s: EC keys are not supported, only RSA", path)
+		}
+		if isPFX(data) {
+			return nil, fmt.Errorf("apk: %s: PKCS#12 keystores are not supported, convert to PEM with openssl pkcs12 -nodes", path)
+		}
+		return nil, fmt.Errorf("apk: %s: unrecognized DER data, want a PKCS#1 or PKCS#8 RSA key", path)
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if _, ok := block.Headers["Proc-Type"]; ok || block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, fmt.Errorf("apk: %s: encrypted keys are not supported", path)
+		}
+		var key *rsa.PrivateKey
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			var k interface{}
+			if k, err = x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+				key, err = rsaKey(k)
+			}
+		case "EC PRIVATE KEY":
+			err = fmt.Errorf("EC keys are not supported, only RSA")
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("apk: %s: %v", path, err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("apk: %s: no private key found", path)
+}
+
+// isPFX reports whether data looks like a PKCS#12 file: a SEQUENCE
+// holding version 3 and a ContentInfo, as in RFC 7292.
+func isPFX(data []byte) bool {
+	var pfx struct {
+		Version  int
+		AuthSafe asn1.RawValue
+		MacData  asn1.RawValue `asn1:"optional"`
+	}
+	if _, err := asn1.Unmarshal(data, &pfx); err != nil {
+		return false
+	}
+	return pfx.Version == 3
+}
+
+// rsaKey returns k, a key parsed from PKCS#8, as an RSA key.
+func rsaKey(k interface{}) (*rsa.PrivateKey, error) {
+	key, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%T keys are not supported, only RSA", k)
+	}
+	return key, nil
+}
+
 // Very sensibly, the Go standard library does not implement PKCS#7.
 // It is an overbearing set of useless abstractions. Unfortunately, APK
 // archives are signed with an RSA key embedded in ASN.1 PKCS#7.
@@ -89,7 +187,7 @@ type signedData struct {
 	Version          int
 	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
 	ContentInfo      contentInfo
-	Certificates     certificate  `asn1:"tag0,explicit"`
+	Certificates     certificate  `asn1:"tag:0,explicit"`
 	SignerInfos      []signerInfo `asn1:"set"`
 }
 
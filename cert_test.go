@@ -0,0 +1,144 @@
+package apk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSignPKCS7OpenSSL checks the CERT.RSA signature block verifies
+// with OpenSSL, as described in the package documentation.
+func TestSignPKCS7OpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not found")
+	}
+	priv := testPrivateKey(t)
+	sf := []byte(certHeader + "SHA1-Digest-Manifest: aJw+u+10C3Enbg8XRCN6jepluYA=\n\n")
+	rsa, err := signPKCS7(rand.Reader, priv, sf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "apk-pkcs7-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rsaPath := filepath.Join(dir, "CERT.RSA")
+	sfPath := filepath.Join(dir, "CERT.SF")
+	if err := ioutil.WriteFile(rsaPath, rsa, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(content []byte) error {
+		if err := ioutil.WriteFile(sfPath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// The certificate is self-signed, so skip chain verification.
+		cmd := exec.Command(openssl, "smime", "-verify", "-noverify",
+			"-inform", "DER", "-in", rsaPath, "-content", sfPath, "-out", os.DevNull)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		return nil
+	}
+	if err := verify(sf); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+	if err := verify(append(sf, "Name: extra\n"...)); err == nil {
+		t.Error("signature verifies over modified content")
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	priv := testPrivateKey(t)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSEC1, err := x509.MarshalECPrivateKey(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pfx, err := asn1.Marshal(struct {
+		Version  int
+		AuthSafe struct{ ContentType asn1.ObjectIdentifier }
+	}{3, struct{ ContentType asn1.ObjectIdentifier }{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "apk-key-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"pkcs1.pem", pkcs1, ""},
+		{"pkcs8.pem", append(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), cert...), ""},
+		{"cert-first.pem", append(cert, pkcs1...), ""},
+		{"pkcs1.der", x509.MarshalPKCS1PrivateKey(priv), ""},
+		{"pkcs8.der", pkcs8, ""},
+		{"cert.pem", cert, "no private key"},
+		{"ec.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecSEC1}), "only RSA"},
+		{"ec-pkcs8.der", ecPKCS8, "only RSA"},
+		{"debug.keystore", []byte{0xfe, 0xed, 0xfe, 0xed, 0, 0, 0, 2}, "keytool"},
+		{"ec.der", ecSEC1, "EC keys are not supported"},
+		{"debug.p12", pfx, "openssl pkcs12"},
+		{"truncated.der", []byte{0x30, 0x82, 0x0a, 0x00}, "unrecognized DER data"},
+		{"garbage.der", []byte{0x30, 0x03, 0x02, 0x01, 0x05}, "unrecognized DER data"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(path, test.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := LoadSigningKey(path)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: err=%v, want error containing %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !priv.Equal(key) {
+			t.Errorf("%s: loaded a different key", test.name)
+		}
+	}
+}
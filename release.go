@@ -6,15 +6,32 @@
 
 // Release is a tool for building the NDK tarballs hosted on dl.google.com.
 //
-// The Go toolchain only needs the gcc compiler and headers, which are ~10MB.
-// The entire NDK is ~400MB. Building smaller toolchain binaries reduces the
-// run time of gomobile init significantly.
+// The Go toolchain only needs the clang compiler, headers and the sysroot
+// libraries for one API level. The entire NDK is over 1GB. Building smaller
+// toolchain tarballs reduces the run time of gomobile init significantly.
+//
+// Usage:
+//
+//	go run release.go [-ndk r26d] [-api 21] [-arch arm,arm64,386,amd64] [-sha256 download=checksum,...]
+//
+// Each NDK download is checked against its SHA-256 before it is used,
+// from the ndkSHA256 table or the -sha256 flag. A download with no known
+// checksum is refused before it is fetched. The table is empty for now,
+// so -sha256 must list the darwin, linux and windows downloads of every
+// release, r26d included:
+//
+//	go run release.go -sha256 android-ndk-r26d-darwin.dmg=<sum>,android-ndk-r26d-linux.zip=<sum>,android-ndk-r26d-windows.zip=<sum>
 package main
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -23,33 +40,109 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
+)
+
+var (
+	ndkVersion = flag.String("ndk", "r26d", "NDK release to package; its downloads must be listed in -sha256")
+	apiLevel   = flag.Int("api", 21, "Android API level of the sysroot libraries")
+	archs      = flag.String("arch", "arm,arm64,386,amd64", "comma-separated GOARCH values to include")
+	sums       = flag.String("sha256", "", "comma-separated download=sha256 checksums to add to ndkSHA256; required for every download while the table is empty")
 )
 
-const ndkVersion = "ndk-r10d"
+// triples maps GOARCH to the target triple naming the NDK's sysroot
+// library directory.
+var triples = map[string]string{
+	"arm":   "arm-linux-androideabi",
+	"arm64": "aarch64-linux-android",
+	"386":   "i686-linux-android",
+	"amd64": "x86_64-linux-android",
+}
 
 type version struct {
 	os   string
 	arch string
 }
 
+// hosts are the developer platforms NDK tarballs are built for.
+// Since r23 the NDK ships a single 64-bit build per host OS. The darwin
+// build is a universal binary, so it also runs on Apple silicon.
 var hosts = []version{
-	// TODO: windows
-	/*
-		{"darwin", "x86"},
-		{"darwin", "x86_64"},
-		{"linux", "x86"},
-	*/
+	{"darwin", "x86_64"},
 	{"linux", "x86_64"},
+	{"windows", "x86_64"},
+}
+
+// prebuilt is the name of the directory holding the host's toolchain
+// binaries.
+func (v version) prebuilt() string {
+	return v.os + "-" + v.arch
+}
+
+// download is the name of the NDK release file for the host.
+func (v version) download() string {
+	name := "android-ndk-" + *ndkVersion + "-" + v.os
+	if v.os == "darwin" {
+		return name + ".dmg"
+	}
+	return name + ".zip"
 }
 
+// extractors unpack an NDK download into a directory, by host OS.
+var extractors = map[string]func(path, dir string) error{
+	// The darwin NDK is a disk image. 7z reads the HFS+ volume in it
+	// without mounting it, on any build machine.
+	"darwin":  inflate,
+	"linux":   unzip,
+	"windows": unzip,
+}
+
+// ndkSHA256 holds the SHA-256 of each NDK download, hex encoded, with
+// any given by the -sha256 flag. A download without an entry is not
+// fetched, so a new NDK version or host needs its checksum added here
+// or passed on the command line.
+//
+// No checksums have been added yet, not even for r26d. Until the
+// published sums are copied in from the NDK downloads page, every
+// download must be given with -sha256.
+var ndkSHA256 = map[string]string{}
+
 var tmpdir string
 
+// cachedir holds a directory per NDK version and host, containing the
+// download, its extracted tree and a stamp file with the SHA-256 the
+// download was verified against. They are reused by later runs unless
+// a different SHA-256 is expected for the download.
+var cachedir string
+
 func main() {
+	flag.Parse()
+	for _, arch := range strings.Split(*archs, ",") {
+		if triples[arch] == "" {
+			log.Fatalf("unknown -arch %q", arch)
+		}
+	}
+	if *sums != "" {
+		for _, s := range strings.Split(*sums, ",") {
+			i := strings.Index(s, "=")
+			if i < 0 {
+				log.Fatalf("-sha256 %q: want download=sha256", s)
+			}
+			ndkSHA256[s[:i]] = strings.ToLower(s[i+1:])
+		}
+	}
+
 	var err error
 	tmpdir, err = ioutil.TempDir("", "gomobile-release-")
 	if err != nil {
 		log.Fatal(err)
 	}
+	cachedir, err = os.UserCacheDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cachedir = filepath.Join(cachedir, "gomobile-release")
 
 	for _, host := range hosts {
 		if err := mkpkg(host); err != nil {
@@ -59,59 +152,193 @@ func main() {
 }
 
 func mkpkg(host version) error {
-	ndkName := "android-" + ndkVersion + "-" + host.os + "-" + host.arch + "."
-	if host.os == "windows" {
-		ndkName += "exe"
-	} else {
-		ndkName += "bin"
-	}
-	url := "http://dl.google.com/android/ndk/" + ndkName
-	log.Printf("%s\n", url)
-	binPath := tmpdir + "/" + ndkName
-	if err := fetch(binPath, url); err != nil {
-		log.Fatal(err)
+	ndkName := host.download()
+	full, err := fetchNDK(host, ndkName)
+	if err != nil {
+		return err
 	}
-	if err := inflate(binPath); err != nil {
+	src, err := ndkRoot(full)
+	if err != nil {
 		return err
 	}
-	// The NDK is unpacked into tmpdir/android-ndk-r10d.
-	// Move the files we want into tmpdir/linux-x86_64/android-ndk-r10d.
+	// The NDK is unpacked somewhere under cachedir/ndk-r26d-linux-x86_64/ndk.
+	// Copy the files we want into tmpdir/linux-x86_64/android-ndk-r26d.
 	// We preserve the same file layout to make the full NDK interchangable
 	// with the cut down file.
-	usr := "android-" + ndkVersion + "/platforms/android-15/arch-arm/usr"
-	gcc := "android-" + ndkVersion + "/toolchains/arm-linux-androideabi-4.8/prebuilt/" + host.os + "-" + host.arch
-	dst := tmpdir + "/" + host.os + "-" + host.arch
-	if err := os.MkdirAll(dst+"/"+usr, 0755); err != nil {
+	llvm := "toolchains/llvm/prebuilt/" + host.prebuilt()
+	root := "android-ndk-" + *ndkVersion
+	dst := tmpdir + "/" + host.os + "-" + host.arch + "/" + root
+	if err := os.MkdirAll(dst+"/"+llvm+"/sysroot/usr/lib", 0755); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(dst+"/"+gcc, 0755); err != nil {
+	if err := copyTree(dst+"/"+llvm, src+"/"+llvm, "bin", "lib"); err != nil {
 		return err
 	}
-	if err := move(dst+"/"+usr, tmpdir+"/"+usr, "include", "lib"); err != nil {
+	if err := copyTree(dst+"/"+llvm+"/sysroot/usr", src+"/"+llvm+"/sysroot/usr", "include"); err != nil {
 		return err
 	}
-	if err := move(dst+"/"+gcc, tmpdir+"/"+gcc, "bin", "lib", "libexec"); err != nil {
-		return err
+	for _, arch := range strings.Split(*archs, ",") {
+		if err := copySysrootLib(dst+"/"+llvm, src+"/"+llvm, triples[arch]); err != nil {
+			return err
+		}
 	}
 
 	// Build the tarball.
-	dst += "/"
-	f, err := os.Create("gomobile-ndk-r10d-" + host.os + "-" + host.arch + ".tgz")
+	return writeTarball("gomobile-ndk-"+*ndkVersion+"-"+host.os+"-"+host.arch+".tgz", tmpdir+"/"+host.os+"-"+host.arch)
+}
+
+// copySysrootLib copies the libraries for triple at apiLevel from the
+// llvm toolchain directory src to dst, along with the static libraries
+// that are shared by all API levels.
+func copySysrootLib(dst, src, triple string) error {
+	lib := "/sysroot/usr/lib/" + triple
+	entries, err := ioutil.ReadDir(src + lib)
 	if err != nil {
 		return err
 	}
-	tw := tar.NewWriter(gzip.NewWriter(bufio.NewWriter(f)))
-	err = filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+	api := fmt.Sprint(*apiLevel)
+	found := false
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && e.Name() == api {
+			found = true
+		}
+		if !e.IsDir() || e.Name() == api {
+			names = append(names, e.Name())
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s: no libraries for API level %d", triple, *apiLevel)
+	}
+	if err := os.MkdirAll(dst+lib, 0755); err != nil {
+		return err
+	}
+	return copyTree(dst+lib, src+lib, names...)
+}
+
+// ndkRoot returns the top directory of the NDK extracted into dir,
+// the shallowest one holding a source.properties file. The search is
+// breadth-first, as the NDK has more source.properties files further
+// down its tree.
+func ndkRoot(dir string) (string, error) {
+	for level := []string{dir}; len(level) > 0; {
+		var next []string
+		for _, d := range level {
+			entries, err := ioutil.ReadDir(d)
+			if err != nil {
+				return "", err
+			}
+			for _, e := range entries {
+				if e.IsDir() {
+					next = append(next, filepath.Join(d, e.Name()))
+				} else if e.Name() == "source.properties" {
+					return d, nil
+				}
+			}
+		}
+		level = next
+	}
+	return "", fmt.Errorf("no NDK found in %s", dir)
+}
+
+// fetchNDK returns the directory holding the extracted NDK download
+// ndkName for host. The download and extraction are skipped if the
+// cache already holds a tree extracted from a verified file, and that
+// file's SHA-256 is the expected one when a checksum is known.
+func fetchNDK(host version, ndkName string) (string, error) {
+	dir := filepath.Join(cachedir, "ndk-"+*ndkVersion+"-"+host.os+"-"+host.arch)
+	src := filepath.Join(dir, "ndk")
+	stamp := filepath.Join(dir, "sha256")
+	want := ndkSHA256[ndkName]
+	if b, err := ioutil.ReadFile(stamp); err == nil && len(b) > 0 && (want == "" || string(b) == want) {
+		log.Printf("%s: cached in %s\n", ndkName, src)
+		return src, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	os.Remove(stamp)
+	if want == "" {
+		return "", fmt.Errorf("%s: no known SHA-256, pass -sha256 %s=<checksum>", ndkName, ndkName)
+	}
+
+	url := "https://dl.google.com/android/repository/" + ndkName
+	log.Printf("%s\n", url)
+	binPath := filepath.Join(dir, ndkName)
+	if err := fetch(binPath, url); err != nil {
+		return "", err
+	}
+	if err := verify(binPath, want); err != nil {
+		// The cached file may be an older build. Start over once.
+		log.Printf("%s: %v, downloading again", ndkName, err)
+		if err := os.Remove(binPath); err != nil {
+			return "", err
+		}
+		if err := fetch(binPath, url); err != nil {
+			return "", err
+		}
+		if err := verify(binPath, want); err != nil {
+			return "", fmt.Errorf("%s: %v", ndkName, err)
+		}
+	}
+
+	extract, ok := extractors[host.os]
+	if !ok {
+		return "", fmt.Errorf("no extractor for %s NDK", host.os)
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(src, 0755); err != nil {
+		return "", err
+	}
+	if err := extract(binPath, src); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(stamp, []byte(want), 0644); err != nil {
+		return "", err
+	}
+	return src, nil
+}
+
+// writeTarball writes the tree rooted at dir to a gzipped tar file,
+// keeping directories, file modes and symlinks so the toolchain it
+// holds can be run once extracted.
+func writeTarball(name, dir string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	gz := gzip.NewWriter(bw)
+	tw := tar.NewWriter(gz)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		err = tw.WriteHeader(&tar.Header{
-			Name: path[len(dst):],
-			Size: info.Size(),
-		})
+		if path == dir {
+			return nil
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
 		if err != nil {
 			return err
 		}
+		hdr.Name = filepath.ToSlash(path[len(dir)+1:])
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
 		f, err := os.Open(path)
 		if err != nil {
 			return err
@@ -120,41 +347,168 @@ func mkpkg(host version) error {
 		f.Close()
 		return err
 	})
-	err2 := tw.Close()
 	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		f.Close()
 		return err
 	}
-	return err2
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
+// fetch downloads url to dst. A failed download is retried with
+// exponential backoff, resuming from the end of the partial file.
 func fetch(dst, url string) error {
-	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0755)
+	const attempts = 5
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			delay := time.Duration(1<<uint(i-1)) * time.Second
+			log.Printf("%s: %v, retrying in %v", url, err, delay)
+			time.Sleep(delay)
+		}
+		if err = fetchRange(dst, url); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// fetchRange appends to dst the part of url it does not yet hold.
+func fetchRange(dst, url string) error {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", fi.Size()))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the Range header, start over.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The file is already complete.
+		return f.Close()
+	default:
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// verify checks that the file at path has the hex-encoded SHA-256 want.
+func verify(path, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("SHA-256 is %s, want %s", got, want)
+	}
+	return nil
+}
+
+// unzip unpacks the zip archive at path into dir, keeping file modes
+// and symlinks.
+func unzip(path, dir string) error {
+	r, err := zip.OpenReader(path)
 	if err != nil {
 		return err
 	}
-	resp, err := http.Get(url)
+	defer r.Close()
+	for _, f := range r.File {
+		name := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(name, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("%s: entry %q outside archive root", path, f.Name)
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := unzipFile(name, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unzipFile(name string, f *zip.File) error {
+	rc, err := f.Open()
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(f, resp.Body)
-	err2 := resp.Body.Close()
-	err3 := f.Close()
+	defer rc.Close()
+	if f.Mode()&os.ModeSymlink != 0 {
+		link, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(string(link), name)
+	}
+	w, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, f.Mode().Perm()|0600)
 	if err != nil {
 		return err
 	}
-	if err2 != nil {
-		return err2
+	if _, err := io.Copy(w, rc); err != nil {
+		w.Close()
+		return err
 	}
-	return err3
+	return w.Close()
 }
 
-func inflate(path string) error {
-	p7zip := "7z"
-	if runtime.GOOS == "darwin" {
-		p7zip = "/Applications/Keka.app/Contents/Resources/keka7z"
+// inflate unpacks a 7-Zip readable archive with the build
+// machine's 7z into dir, falling back to the copy bundled with Keka
+// on OS X.
+func inflate(path, dir string) error {
+	p7zip, err := exec.LookPath("7z")
+	if err != nil && runtime.GOOS == "darwin" {
+		p7zip, err = "/Applications/Keka.app/Contents/Resources/keka7z", nil
+	}
+	if err != nil {
+		return err
 	}
 	cmd := exec.Command(p7zip, "x", path)
-	cmd.Dir = tmpdir
+	cmd.Dir = dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		os.Stderr.Write(out)
@@ -163,11 +517,48 @@ func inflate(path string) error {
 	return nil
 }
 
-func move(dst, src string, names ...string) error {
+// copyTree copies the named files and directories in src to dst,
+// keeping file modes and symlinks.
+func copyTree(dst, src string, names ...string) error {
 	for _, name := range names {
-		if err := os.Rename(src+"/"+name, dst+"/"+name); err != nil {
+		root := src + "/" + name
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			target := dst + "/" + name + path[len(root):]
+			switch {
+			case info.IsDir():
+				return os.MkdirAll(target, info.Mode().Perm()|0700)
+			case info.Mode()&os.ModeSymlink != 0:
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				return os.Symlink(link, target)
+			}
+			return copyFile(target, path, info.Mode().Perm())
+		})
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func copyFile(dst, src string, perm os.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
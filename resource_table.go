@@ -0,0 +1,85 @@
+package apk
+
+import (
+	"fmt"
+	"unicode/utf16"
+)
+
+// A ResourceTable is the compiled resource table of an APK, stored in
+// the archive as resources.arsc.
+//
+// For now a table declares a single resource package with no resources.
+// Some tools expect every APK to have a resources.arsc, and a package
+// declaration is enough to satisfy them.
+type ResourceTable struct {
+	pkgID   uint32
+	pkgName string
+}
+
+// NewResourceTable returns a table declaring the resource package
+// pkgName with the package ID pkgID, which is 0x7f for an app.
+func NewResourceTable(pkgID uint32, pkgName string) *ResourceTable {
+	return &ResourceTable{pkgID: pkgID, pkgName: pkgName}
+}
+
+// MarshalBinary encodes the table in the resources.arsc format.
+//
+// The layout is:
+//
+//	Chunk: Table (header)
+//	Chunk: String Pool (values)
+//	Chunk: Package
+//		Chunk: String Pool (type names)
+//		Chunk: String Pool (key names)
+func (t *ResourceTable) MarshalBinary() ([]byte, error) {
+	if t.pkgID == 0 || t.pkgID > 0xff {
+		return nil, fmt.Errorf("apk: resource package ID 0x%x out of range", t.pkgID)
+	}
+	name := utf16.Encode([]rune(t.pkgName))
+	if len(name) >= pkgNameLen {
+		return nil, fmt.Errorf("apk: resource package name %q too long", t.pkgName)
+	}
+
+	values, types, keys := new(binStringPool), new(binStringPool), new(binStringPool)
+	const pkgHeaderSize = 8 + // chunk header
+		4 + // id
+		2*pkgNameLen + // name
+		4 + // type strings offset
+		4 + // last public type
+		4 + // key strings offset
+		4 + // last public key
+		4 // type ID offset
+	pkgSize := pkgHeaderSize + types.size() + keys.size()
+	size := 12 + values.size() + pkgSize
+
+	b := make([]byte, 0, size)
+	b = appendU16(b, uint16(headerTable))
+	b = appendU16(b, 12) // chunk header size
+	b = appendU32(b, uint32(size))
+	b = appendU32(b, 1) // package count
+	b = values.append(b)
+
+	b = appendU16(b, uint16(headerTablePackage))
+	b = appendU16(b, pkgHeaderSize)
+	b = appendU32(b, uint32(pkgSize))
+	b = appendU32(b, t.pkgID)
+	for i := 0; i < pkgNameLen; i++ {
+		if i < len(name) {
+			b = appendU16(b, name[i])
+		} else {
+			b = appendU16(b, 0)
+		}
+	}
+	b = appendU32(b, pkgHeaderSize) // type strings offset
+	b = appendU32(b, 0)             // last public type
+	b = appendU32(b, uint32(pkgHeaderSize+types.size()))
+	b = appendU32(b, 0) // last public key
+	b = appendU32(b, 0) // type ID offset
+	b = types.append(b)
+	b = keys.append(b)
+	return b, nil
+}
+
+// pkgNameLen is the size in UTF-16 code units of the NUL-terminated
+// package name field of a ResTable_package.
+const pkgNameLen = 128
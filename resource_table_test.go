@@ -0,0 +1,111 @@
+package apk
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestResourceTableEmpty(t *testing.T) {
+	b, err := NewResourceTable(0x7f, "com.example").MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u16 := func(off int) uint16 { return binary.LittleEndian.Uint16(b[off:]) }
+	u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(b[off:]) }
+
+	if headerType(u16(0)) != headerTable || u16(2) != 12 || int(u32(4)) != len(b) || u32(8) != 1 {
+		t.Fatalf("bad table header % x", b[:12])
+	}
+	off := 12
+	if u16(off) != headerStringPool || u32(off+8) != 0 {
+		t.Fatalf("bad value string pool % x", b[off:off+28])
+	}
+	off += int(u32(off + 4))
+
+	pkg := off
+	if u16(pkg) != headerTablePackage || int(u32(pkg+4)) != len(b)-pkg {
+		t.Fatalf("bad package header % x", b[pkg:pkg+12])
+	}
+	if id := u32(pkg + 8); id != 0x7f {
+		t.Errorf("package ID 0x%x, want 0x7f", id)
+	}
+	var name []uint16
+	for i := pkg + 12; u16(i) != 0; i += 2 {
+		name = append(name, u16(i))
+	}
+	if got := string(utf16.Decode(name)); got != "com.example" {
+		t.Errorf("package name %q, want com.example", got)
+	}
+	for _, field := range []int{12 + 256, 12 + 256 + 8} { // type strings, key strings
+		pool := pkg + int(u32(pkg+field))
+		if u16(pool) != headerStringPool || u32(pool+8) != 0 {
+			t.Errorf("bad string pool at 0x%x", pool)
+		}
+	}
+}
+
+func TestResourceTableErrors(t *testing.T) {
+	for _, tbl := range []*ResourceTable{
+		NewResourceTable(0, "com.example"),
+		NewResourceTable(0x100, "com.example"),
+		NewResourceTable(0x7f, strings.Repeat("a", 128)),
+	} {
+		if _, err := tbl.MarshalBinary(); err == nil {
+			t.Errorf("NewResourceTable(0x%x, %q): no error", tbl.pkgID, tbl.pkgName)
+		}
+	}
+}
+
+// TestResourceTableAapt2 checks aapt2 can read an APK holding an empty
+// resource table.
+func TestResourceTableAapt2(t *testing.T) {
+	aapt2, err := exec.LookPath("aapt2")
+	if err != nil {
+		t.Skip("aapt2 not found")
+	}
+	arsc, err := NewResourceTable(0x7f, "com.example").MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, testPrivateKey(t))
+	for _, e := range []struct {
+		name string
+		data []byte
+	}{
+		{"AndroidManifest.xml", []byte(input)},
+		{"resources.arsc", arsc},
+	} {
+		f, err := w.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "empty.apk")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(aapt2, "dump", "resources", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("aapt2 dump resources: %v\n%s", err, out)
+	}
+	if !bytes.Contains(out, []byte("com.example")) {
+		t.Errorf("aapt2 output does not name the package:\n%s", out)
+	}
+}
@@ -73,18 +73,42 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
+	"strings"
+	"time"
 )
 
 // NewWriter returns a new Writer writing an APK file to w.
 // The APK will be signed with key.
 func NewWriter(w io.Writer, priv *rsa.PrivateKey) *Writer {
-	apkw := &Writer{priv: priv}
+	apkw := &Writer{Align: true, priv: priv}
 	apkw.w = zip.NewWriter(&countWriter{apkw: apkw, w: w})
 	return apkw
 }
 
 // Writer implements an APK file writer.
 type Writer struct {
+	// Align pads each entry so its contents start on a 4-byte boundary.
+	// It is true by default and should only be turned off to compare
+	// against a plain stored ZIP. Android cannot mmap the entries of an
+	// unaligned APK: it may still install, but runs slower and uses
+	// more memory. Set Align before the first call to Create.
+	Align bool
+
+	// Modified is the modification time recorded for entries added by
+	// Create. The zero value records none. Entries added by AddFS keep
+	// the modification time of their source file instead.
+	//
+	// Times are stored in UTC with the two-second resolution of the ZIP
+	// local and central directory headers.
+	Modified time.Time
+
+	// Release marks the APK as a release build. Writing it then fails if
+	// the AndroidManifest.xml given to Create sets android:debuggable on
+	// <application>, which lets anyone attach a debugger to the app and
+	// read its data. A manifest added by AddManifestBytes is not checked.
+	Release bool
+
 	offset   int
 	w        *zip.Writer
 	priv     *rsa.PrivateKey
@@ -96,33 +120,58 @@ type Writer struct {
 //
 // The name must be a relative path. The file's contents must be written to
 // the returned io.Writer before the next call to Create or Close.
+//
+// Entries are streamed to the archive in the order Create is called; the
+// Writer does not buffer them to reorder. Android reads an APK fastest when
+// AndroidManifest.xml comes first, then resources.arsc, then classes.dex,
+// native libraries and assets, so callers should create entries in that
+// order. Each entry is 4-byte aligned wherever it falls, and the META-INF
+// signature files are always written last by Close.
+//
+// A name ending in a slash adds a directory entry, which cannot be written
+// to and is not listed in the signature files. An empty file is added by
+// not writing to it at all.
 func (w *Writer) Create(name string) (io.Writer, error) {
+	return w.createModified(name, w.Modified)
+}
+
+func (w *Writer) createModified(name string, modified time.Time) (io.Writer, error) {
 	if err := w.clearCur(); err != nil {
 		return nil, fmt.Errorf("apk: %v", err)
 	}
 	if name == "AndroidManifest.xml" {
 		w.cur = &fileWriter{
-			name: name,
-			w:    new(bytes.Buffer),
-			sha1: sha1.New(),
+			name:     name,
+			w:        new(bytes.Buffer),
+			sha1:     sha1.New(),
+			modified: modified,
 		}
 		return w.cur, nil
 	}
-	return w.create(name)
+	return w.create(name, modified)
 }
 
-func (w *Writer) create(name string) (io.Writer, error) {
+func (w *Writer) create(name string, modified time.Time) (io.Writer, error) {
 	// Align start of file contents by using Extra as padding.
 	if err := w.w.Flush(); err != nil { // for exact offset
 		return nil, fmt.Errorf("apk: Create(%q): %v", name, err)
 	}
 	const fileHeaderLen = 30 // + filename + extra
 	start := w.offset + fileHeaderLen + len(name)
-	extra := start % 4
+	extra := 0
+	if w.Align {
+		extra = (4 - start%4) % 4
+	}
 
+	// The DOS time fields are set directly. Setting Modified would make
+	// archive/zip append an extended timestamp to Extra, after the
+	// padding, where zip readers would misparse it.
+	date, tm := msDosTime(modified)
 	zipfw, err := w.w.CreateHeader(&zip.FileHeader{
-		Name:  name,
-		Extra: make([]byte, extra),
+		Name:         name,
+		Extra:        make([]byte, extra),
+		ModifiedDate: date,
+		ModifiedTime: tm,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("apk: Create: %v", err)
@@ -135,9 +184,83 @@ func (w *Writer) create(name string) (io.Writer, error) {
 	return w.cur, nil
 }
 
+// AddManifestBytes adds AndroidManifest.xml to the APK archive from an
+// already compiled binary XML manifest, such as one produced by aapt2.
+// Unlike a manifest written through Create, it is stored as is.
+func (w *Writer) AddManifestBytes(manifest []byte) error {
+	if text := bytes.TrimLeft(manifest, " \t\r\n\ufeff"); len(text) > 0 && text[0] == '<' {
+		return fmt.Errorf(`apk: AddManifestBytes: manifest is text XML, write it to Create("AndroidManifest.xml")`)
+	}
+	if len(manifest) < 8 || manifest[0] != byte(headerXML) || manifest[1] != 0 {
+		return fmt.Errorf("apk: AddManifestBytes: manifest is not binary XML")
+	}
+	if err := w.clearCur(); err != nil {
+		return fmt.Errorf("apk: %v", err)
+	}
+	f, err := w.create("AndroidManifest.xml", w.Modified)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(manifest); err != nil {
+		return fmt.Errorf("apk: %v", err)
+	}
+	return nil
+}
+
+// AddFS adds the files in fsys to the APK archive, each named prefix
+// followed by its path in fsys. Files are added in lexical order, as
+// if by Create, and directories are skipped. Each entry keeps the
+// modification time of its file.
+func (w *Writer) AddFS(fsys fs.FS, prefix string) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("apk: %v", err)
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("apk: %v", err)
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			return fmt.Errorf("apk: %v", err)
+		}
+		defer f.Close()
+		fw, err := w.createModified(prefix+name, info.ModTime())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fw, f); err != nil {
+			return fmt.Errorf("apk: %s: %v", name, err)
+		}
+		return nil
+	})
+}
+
+// SetComment sets the ZIP archive comment, written at the end of the
+// central directory when the APK is closed.
+//
+// The v1 (JAR) signature written by this package covers entry contents,
+// not the archive comment, so the comment does not affect it. APK
+// Signature Scheme v2 signs the end of central directory record, which
+// includes the comment. A v2-signed APK is invalidated by any comment
+// change made after signing, so the comment must be set before Close.
+func (w *Writer) SetComment(comment string) error {
+	if err := w.w.SetComment(comment); err != nil {
+		return fmt.Errorf("apk: %v", err)
+	}
+	return nil
+}
+
 // Close finishes writing the APK. This includes writing the manifest and
 // signing the archive, and writing the ZIP central directory.
 //
+// The SHA1 digest of each entry is computed as its contents are written,
+// so Close never reads entry data back. Only the generated MANIFEST.MF
+// and CERT.SF are hashed here.
+//
 // It does not close the underlying writer.
 func (w *Writer) Close() error {
 	if err := w.clearCur(); err != nil {
@@ -209,13 +332,12 @@ func (w *Writer) clearCur() error {
 	if w.cur == nil {
 		return nil
 	}
-	if w.cur.name == "AndroidManifest.xml" {
-		buf := w.cur.w.(*bytes.Buffer)
-		b, err := binaryXML(buf)
+	if buf, ok := w.cur.w.(*bytes.Buffer); ok && w.cur.name == "AndroidManifest.xml" {
+		b, err := binaryXML(buf, w.Release)
 		if err != nil {
 			return fmt.Errorf("apk: %v", err)
 		}
-		f, err := w.create("AndroidManifest.xml")
+		f, err := w.create("AndroidManifest.xml", w.cur.modified)
 		if err != nil {
 			return err
 		}
@@ -223,10 +345,13 @@ func (w *Writer) clearCur() error {
 			return fmt.Errorf("apk: %v", err)
 		}
 	}
-	w.manifest = append(w.manifest, manifestEntry{
-		name: w.cur.name,
-		sha1: w.cur.sha1,
-	})
+	// Like jarsigner, only files are listed in the manifest.
+	if !strings.HasSuffix(w.cur.name, "/") {
+		w.manifest = append(w.manifest, manifestEntry{
+			name: w.cur.name,
+			sha1: w.cur.sha1,
+		})
+	}
 	w.cur.closed = true
 	w.cur = nil
 	return nil
@@ -249,10 +374,11 @@ func (c *countWriter) Write(p []byte) (n int, err error) {
 }
 
 type fileWriter struct {
-	name   string
-	w      io.Writer
-	sha1   hash.Hash
-	closed bool
+	name     string
+	w        io.Writer
+	sha1     hash.Hash
+	modified time.Time
+	closed   bool
 }
 
 func (w *fileWriter) Write(p []byte) (n int, err error) {
@@ -262,3 +388,15 @@ func (w *fileWriter) Write(p []byte) (n int, err error) {
 	w.sha1.Write(p)
 	return w.w.Write(p)
 }
+
+// msDosTime returns t in UTC as the date and time fields of a ZIP file
+// header. Times before 1980, which the fields cannot hold, are zero.
+func msDosTime(t time.Time) (date, tm uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		return 0, 0
+	}
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tm = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, tm
+}
@@ -0,0 +1,532 @@
+package apk
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+	testKeyErr  error
+)
+
+func testPrivateKey(tb testing.TB) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		testKey, testKeyErr = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	if testKeyErr != nil {
+		tb.Fatal(testKeyErr)
+	}
+	return testKey
+}
+
+func TestWriterAddFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"icon.png":        {Data: []byte("png")},
+		"fonts/a.ttf":     {Data: []byte("font a")},
+		"fonts/b/b.ttf":   {Data: []byte("font b")},
+		"fonts/b/empty.d": {Mode: fs.ModeDir},
+	}
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, testPrivateKey(t))
+	if err := w.AddFS(fsys, "assets/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ name, data string }{
+		{"assets/fonts/a.ttf", "font a"},
+		{"assets/fonts/b/b.ttf", "font b"},
+		{"assets/icon.png", "png"},
+	}
+	for i, f := range r.File[:len(want)] {
+		if f.Name != want[i].name {
+			t.Errorf("entry %d is %q, want %q", i, f.Name, want[i].name)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want[i].data {
+			t.Errorf("%s contains %q, want %q", f.Name, data, want[i].data)
+		}
+	}
+	if f := r.File[len(want)]; f.Name != "META-INF/MANIFEST.MF" {
+		t.Errorf("entry %d is %q, want META-INF/MANIFEST.MF", len(want), f.Name)
+	}
+}
+
+func TestWriterEntries(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, testPrivateKey(t))
+	entries := []struct{ name, data string }{
+		{"classes.dex", "dex\n035\x00"},
+		{"assets/a.txt", "hello, world"},
+	}
+	for _, e := range entries {
+		f, err := w.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		files[f.Name] = f
+		if f.Method != zip.Store {
+			t.Errorf("%s: method %d, want zip.Store", f.Name, f.Method)
+		}
+		off, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if off%4 != 0 {
+			t.Errorf("%s: data at offset %d, not 4-byte aligned", f.Name, off)
+		}
+	}
+	for _, e := range entries {
+		f := files[e.name]
+		if f == nil {
+			t.Errorf("missing entry %s", e.name)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != e.data {
+			t.Errorf("%s contains %q, want %q", e.name, data, e.data)
+		}
+	}
+}
+
+func TestWriterEmptyEntries(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, testPrivateKey(t))
+	if _, err := w.Create("assets/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Create("assets/empty.txt"); err != nil {
+		t.Fatal(err)
+	}
+	const so = "\x7fELF library"
+	f, err := w.Create("lib/arm64-v8a/libfoo.so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(so)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for _, f := range r.File {
+		off, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if off%4 != 0 {
+			t.Errorf("%s: data at offset %d, not 4-byte aligned", f.Name, off)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		contents[f.Name] = string(data)
+	}
+	for name, want := range map[string]string{
+		"assets/":                 "",
+		"assets/empty.txt":        "",
+		"lib/arm64-v8a/libfoo.so": so,
+	} {
+		got, ok := contents[name]
+		if !ok {
+			t.Errorf("missing entry %s", name)
+		} else if got != want {
+			t.Errorf("%s contains %q, want %q", name, got, want)
+		}
+	}
+	if !r.File[0].FileInfo().IsDir() {
+		t.Errorf("assets/ is not a directory")
+	}
+
+	// Like jarsigner, directories are not listed in the manifest.
+	manifest := contents["META-INF/MANIFEST.MF"]
+	if strings.Contains(manifest, "Name: assets/\n") {
+		t.Errorf("MANIFEST.MF lists the assets/ directory:\n%s", manifest)
+	}
+	if !strings.Contains(manifest, "Name: assets/empty.txt\n") {
+		t.Errorf("MANIFEST.MF does not list assets/empty.txt:\n%s", manifest)
+	}
+}
+
+func TestWriterSetComment(t *testing.T) {
+	const comment = "built by gobuildapk"
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, testPrivateKey(t))
+	f, err := w.Create("classes.dex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("dex\n035\x00")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetComment(strings.Repeat("x", 1<<16)); err == nil {
+		t.Error("64KB comment accepted")
+	}
+	if err := w.SetComment(comment); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Comment != comment {
+		t.Errorf("archive comment %q, want %q", r.Comment, comment)
+	}
+}
+
+func TestWriterNoAlign(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, testPrivateKey(t))
+	w.Align = false
+	for _, name := range []string{"a", "bb", "ccc"} {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first local file header is at offset 0. Without padding,
+	// its data follows the 30-byte header and the name directly.
+	off, err := r.File[0].DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(30 + len("a")); off != want {
+		t.Errorf("data of a at offset %d, want %d", off, want)
+	}
+}
+
+func TestWriterModified(t *testing.T) {
+	created := time.Date(2020, 2, 29, 12, 30, 10, 0, time.UTC)
+	copied := time.Date(2015, 6, 1, 8, 0, 0, 0, time.FixedZone("PDT", -7*3600))
+	fsys := fstest.MapFS{
+		"a.txt": {Data: []byte("a"), ModTime: copied},
+	}
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, testPrivateKey(t))
+	w.Modified = created
+	f, err := w.Create("AndroidManifest.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(input)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddFS(fsys, "assets/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		want := created
+		if f.Name == "assets/a.txt" {
+			want = copied
+		}
+		if !f.Modified.Equal(want) {
+			t.Errorf("%s modified %v, want %v", f.Name, f.Modified, want)
+		}
+		if off, err := f.DataOffset(); err != nil || off%4 != 0 {
+			t.Errorf("%s: data at offset %d, %v", f.Name, off, err)
+		}
+	}
+}
+
+func TestWriterRelease(t *testing.T) {
+	write := func(release bool, manifest string) error {
+		w := NewWriter(new(bytes.Buffer), testPrivateKey(t))
+		w.Release = release
+		f, err := w.Create("AndroidManifest.xml")
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte(manifest)); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	// The test manifest is debuggable.
+	if err := write(false, input); err != nil {
+		t.Fatalf("debug build: %v", err)
+	}
+	err := write(true, input)
+	if err == nil {
+		t.Fatal("release build of a debuggable manifest succeeded")
+	}
+	if want := "14: application: android:debuggable is true in a release build"; !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("error %q, want suffix %q", err, want)
+	}
+	notDebuggable := strings.Replace(input, `android:debuggable="true"`, `android:debuggable="false"`, 1)
+	if err := write(true, notDebuggable); err != nil {
+		t.Errorf("release build: %v", err)
+	}
+}
+
+func TestWriterAddManifestBytes(t *testing.T) {
+	manifest, err := encode(t, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, testPrivateKey(t))
+	if err := w.AddManifestBytes([]byte(input)); err == nil {
+		t.Error("text manifest accepted")
+	}
+	if err := w.AddManifestBytes([]byte("PK\x03\x04")); err == nil {
+		t.Error("non-XML manifest accepted")
+	}
+	if err := w.AddManifestBytes(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.File[0]
+	if f.Name != "AndroidManifest.xml" {
+		t.Fatalf("first entry is %q", f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, manifest) {
+		t.Error("stored manifest differs from the compiled one")
+	}
+	sum := sha1.Sum(manifest)
+	mf, err := r.Open("META-INF/MANIFEST.MF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mf.Close()
+	mfData, err := ioutil.ReadAll(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := jarSections(t, mfData)["AndroidManifest.xml"], base64.StdEncoding.EncodeToString(sum[:]); got != want {
+		t.Errorf("MANIFEST.MF digest %q, want %q", got, want)
+	}
+}
+
+// TestWriterSignature writes a minimal APK and checks its v1 signature
+// is self-consistent: the entry digests match MANIFEST.MF, the digests in
+// CERT.SF match MANIFEST.MF, and CERT.RSA holds a signature of CERT.SF.
+func TestWriterSignature(t *testing.T) {
+	priv := testPrivateKey(t)
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, priv)
+	entries := []struct{ name, data string }{
+		{"AndroidManifest.xml", input},
+		{"lib/arm64-v8a/libtest.so", "\x7fELF not really"},
+	}
+	for _, e := range entries {
+		f, err := w.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+	}
+	if err := validateBinaryXML(files["AndroidManifest.xml"]); err != nil {
+		t.Errorf("AndroidManifest.xml: %v", err)
+	}
+
+	manifest := files["META-INF/MANIFEST.MF"]
+	digests := jarSections(t, manifest)
+	if len(digests) != len(entries) {
+		t.Errorf("MANIFEST.MF has %d entries, want %d", len(digests), len(entries))
+	}
+	for _, e := range entries {
+		sum := sha1.Sum(files[e.name])
+		if got, want := digests[e.name], base64.StdEncoding.EncodeToString(sum[:]); got != want {
+			t.Errorf("MANIFEST.MF digest of %s is %q, want %q", e.name, got, want)
+		}
+	}
+
+	sf := files["META-INF/CERT.SF"]
+	sum := sha1.Sum(manifest)
+	if want := "SHA1-Digest-Manifest: " + base64.StdEncoding.EncodeToString(sum[:]) + "\n"; !bytes.Contains(sf, []byte(want)) {
+		t.Errorf("CERT.SF missing %q", want)
+	}
+	sfDigests := jarSections(t, sf)
+	for _, e := range entries {
+		section := fmt.Sprintf("Name: %s\r\nSHA1-Digest: %s\r\n\r\n", e.name, digests[e.name])
+		sum := sha1.Sum([]byte(section))
+		if got, want := sfDigests[e.name], base64.StdEncoding.EncodeToString(sum[:]); got != want {
+			t.Errorf("CERT.SF digest of %s is %q, want %q", e.name, got, want)
+		}
+	}
+
+	var p7 pkcs7SignedData
+	if _, err := asn1.Unmarshal(files["META-INF/CERT.RSA"], &p7); err != nil {
+		t.Fatalf("CERT.RSA: %v", err)
+	}
+	sum = sha1.Sum(sf)
+	sig := p7.Content.SignerInfos[0].EncryptedDigest
+	if err := rsa.VerifyPKCS1v15(&priv.PublicKey, crypto.SHA1, sum[:], sig); err != nil {
+		t.Errorf("CERT.RSA does not sign CERT.SF: %v", err)
+	}
+}
+
+// jarSections returns the SHA1-Digest of each named section of a JAR
+// manifest or signature file.
+func jarSections(t *testing.T, b []byte) map[string]string {
+	digests := make(map[string]string)
+	for _, section := range strings.Split(string(b), "\n\n") {
+		var name, digest string
+		for _, line := range strings.Split(section, "\n") {
+			if strings.HasPrefix(line, "Name: ") {
+				name = line[len("Name: "):]
+			}
+			if strings.HasPrefix(line, "SHA1-Digest: ") {
+				digest = line[len("SHA1-Digest: "):]
+			}
+		}
+		if name != "" {
+			digests[name] = digest
+		}
+	}
+	return digests
+}
+
+// BenchmarkWriter writes an APK with many small entries, as found in
+// asset-heavy games. Entry digests are computed as the contents are
+// written, so Close only formats the manifest and signs it.
+func BenchmarkWriter(b *testing.B) {
+	const entries = 5000
+	priv := testPrivateKey(b)
+	data := bytes.Repeat([]byte("apk\n"), 1<<10)
+
+	b.SetBytes(entries * int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := NewWriter(ioutil.Discard, priv)
+		for j := 0; j < entries; j++ {
+			f, err := w.Create(fmt.Sprintf("assets/%04d.bin", j))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := f.Write(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}